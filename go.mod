@@ -4,7 +4,9 @@ go 1.23
 
 require (
 	github.com/golang-jwt/jwt/v5 v5.2.0
+	github.com/lib/pq v1.10.9
 	github.com/redis/go-redis/v9 v9.4.0
+	golang.org/x/crypto v0.20.0
 	google.golang.org/grpc v1.60.1
 	google.golang.org/protobuf v1.32.0
 )
@@ -13,8 +15,6 @@ require (
 	github.com/cespare/xxhash/v2 v2.2.0 // indirect
 	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
 	github.com/golang/protobuf v1.5.3 // indirect
-	github.com/lib/pq v1.10.9 // indirect
-	golang.org/x/crypto v0.20.0 // indirect
 	golang.org/x/net v0.21.0 // indirect
 	golang.org/x/sys v0.17.0 // indirect
 	golang.org/x/text v0.14.0 // indirect
@@ -1,54 +1,91 @@
 package auth
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
-	"os"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 )
 
+// AccessTokenTTL is how long an access token is accepted. Clients renew it
+// with their refresh token rather than holding a long-lived credential.
+const AccessTokenTTL = 15 * time.Minute
+
+// tokenIssuer is the iss of every token the gateway signs. Access tokens are
+// told apart from the other kinds signed with the same keys by their aud.
+const (
+	tokenIssuer    = "url-shortener"
+	accessAudience = "access"
+)
+
 type Claims struct {
 	UserID string `json:"user_id"`
+	Admin  bool   `json:"admin,omitempty"`
+	// IssuedAtMs is the issue time in Unix milliseconds. The standard iat
+	// claim only has whole seconds, too coarse to tell a token from a login
+	// right after logging out of all devices from the tokens that logout
+	// revoked.
+	IssuedAtMs int64 `json:"iat_ms,omitempty"`
 	jwt.RegisteredClaims
 }
 
-func getJWTSecret() []byte {
-	secret := os.Getenv("JWT_SECRET")
-	if secret == "" {
-		panic("JWT_SECRET environment variable is not set")
+// GenerateToken issues an access token for userID. Each token gets its own
+// ID (jti) so that it can be revoked on its own.
+func GenerateToken(userID string, admin bool) (string, error) {
+	tokenID, err := randomHex(16)
+	if err != nil {
+		return "", err
 	}
-	return []byte(secret)
-}
 
-func GenerateToken(userID string) (string, error) {
+	now := time.Now()
 	claims := Claims{
-		UserID: userID,
+		UserID:     userID,
+		Admin:      admin,
+		IssuedAtMs: now.UnixMilli(),
 		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(24 * time.Hour)),
-			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			ID:        tokenID,
+			Issuer:    tokenIssuer,
+			Audience:  jwt.ClaimStrings{accessAudience},
+			ExpiresAt: jwt.NewNumericDate(now.Add(AccessTokenTTL)),
+			IssuedAt:  jwt.NewNumericDate(now),
 		},
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(getJWTSecret())
+	return signToken(claims)
 }
 
 func ValidateToken(tokenString string) (*Claims, error) {
-	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		}
-		return getJWTSecret(), nil
-	})
-
+	token, err := parseToken(tokenString, &Claims{}, jwt.WithIssuer(tokenIssuer), jwt.WithAudience(accessAudience))
 	if err != nil {
 		return nil, err
 	}
 
-	if claims, ok := token.Claims.(*Claims); ok && token.Valid {
-		return claims, nil
+	// Tokens from before revocation existed carry no ID or millisecond issue
+	// time.
+	claims, ok := token.Claims.(*Claims)
+	if !ok || !token.Valid || claims.UserID == "" || claims.ID == "" || claims.IssuedAtMs == 0 {
+		return nil, fmt.Errorf("invalid token")
 	}
 
-	return nil, fmt.Errorf("invalid token")
+	if revocations != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+
+		if err := revocations.check(ctx, claims); err != nil {
+			return nil, err
+		}
+	}
+
+	return claims, nil
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
 }
@@ -0,0 +1,185 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var ErrNoKeySet = errors.New("no signing keys loaded")
+
+// Key is one key of a KeySet. Retired keys only have their public half, which
+// keeps the tokens they signed valid until those expire.
+type Key struct {
+	ID      string
+	Method  jwt.SigningMethod
+	Public  crypto.PublicKey
+	private crypto.PrivateKey
+}
+
+// KeySet holds the keys tokens are signed and verified with. Every token
+// names its key in the kid header, so new keys can be introduced while tokens
+// signed by older ones are still in use.
+type KeySet struct {
+	keys    map[string]*Key
+	signing *Key
+}
+
+// keys is used by GenerateToken and ValidateToken once UseKeySet is called.
+var keys *KeySet
+
+// UseKeySet makes tokens be signed and verified with ks.
+func UseKeySet(ks *KeySet) {
+	keys = ks
+}
+
+// LoadKeySet reads every .pem file in dir. A file holds either a private key
+// (RSA, signed with RS256, or Ed25519, signed with EdDSA) or just a public
+// key, and its name without the extension is the key ID. Tokens are signed
+// with the private key named signingKeyID, which may be left empty when there
+// is only one.
+func LoadKeySet(dir, signingKeyID string) (*KeySet, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+
+	ks := &KeySet{keys: make(map[string]*Key)}
+	var privateKeys []*Key
+
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		key, err := parseKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		key.ID = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+
+		ks.keys[key.ID] = key
+		if key.private != nil {
+			privateKeys = append(privateKeys, key)
+		}
+	}
+
+	switch {
+	case signingKeyID != "":
+		key, ok := ks.keys[signingKeyID]
+		if !ok || key.private == nil {
+			return nil, fmt.Errorf("no private key %q in %s", signingKeyID, dir)
+		}
+		ks.signing = key
+	case len(privateKeys) == 1:
+		ks.signing = privateKeys[0]
+	case len(privateKeys) == 0:
+		return nil, fmt.Errorf("no private key in %s", dir)
+	default:
+		return nil, fmt.Errorf("%d private keys in %s, pick the signing key by ID", len(privateKeys), dir)
+	}
+
+	return ks, nil
+}
+
+func parseKey(data []byte) (*Key, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data")
+	}
+
+	var parsed interface{}
+	var err error
+	switch block.Type {
+	case "PRIVATE KEY":
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PUBLIC KEY":
+		parsed, err = x509.ParsePKIXPublicKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		parsed, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	switch k := parsed.(type) {
+	case *rsa.PrivateKey:
+		return &Key{Method: jwt.SigningMethodRS256, Public: &k.PublicKey, private: k}, nil
+	case *rsa.PublicKey:
+		return &Key{Method: jwt.SigningMethodRS256, Public: k}, nil
+	case ed25519.PrivateKey:
+		return &Key{Method: jwt.SigningMethodEdDSA, Public: k.Public(), private: k}, nil
+	case ed25519.PublicKey:
+		return &Key{Method: jwt.SigningMethodEdDSA, Public: k}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", parsed)
+	}
+}
+
+// Keys returns every key of the set, ordered by ID.
+func (ks *KeySet) Keys() []*Key {
+	list := make([]*Key, 0, len(ks.keys))
+	for _, key := range ks.keys {
+		list = append(list, key)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// sign signs claims with the signing key and names it in the kid header.
+func (ks *KeySet) sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(ks.signing.Method, claims)
+	token.Header["kid"] = ks.signing.ID
+	return token.SignedString(ks.signing.private)
+}
+
+// verificationKey is the jwt.Keyfunc of the set. The key is picked by the
+// token's kid header and must match the token's algorithm.
+func (ks *KeySet) verificationKey(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	key, ok := ks.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown key %q", kid)
+	}
+
+	if token.Method.Alg() != key.Method.Alg() {
+		return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+	}
+
+	return key.Public, nil
+}
+
+// signToken signs claims with the key set in use.
+func signToken(claims jwt.Claims) (string, error) {
+	if keys == nil {
+		return "", ErrNoKeySet
+	}
+	return keys.sign(claims)
+}
+
+// parseToken verifies tokenString with the key set in use and decodes it
+// into claims.
+func parseToken(tokenString string, claims jwt.Claims, options ...jwt.ParserOption) (*jwt.Token, error) {
+	if keys == nil {
+		return nil, ErrNoKeySet
+	}
+
+	options = append(options, jwt.WithValidMethods([]string{jwt.SigningMethodRS256.Alg(), jwt.SigningMethodEdDSA.Alg()}))
+	return jwt.ParseWithClaims(tokenString, claims, keys.verificationKey, options...)
+}
@@ -0,0 +1,38 @@
+package auth
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const linkUnlockAudience = "link-unlock"
+
+// GenerateLinkToken issues a short-lived token proving that the holder
+// entered the password of a protected short link.
+func GenerateLinkToken(shortCode string, ttl time.Duration) (string, error) {
+	claims := jwt.RegisteredClaims{
+		Issuer:    tokenIssuer,
+		Subject:   shortCode,
+		Audience:  jwt.ClaimStrings{linkUnlockAudience},
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(ttl)),
+		IssuedAt:  jwt.NewNumericDate(time.Now()),
+	}
+
+	return signToken(claims)
+}
+
+// ValidateLinkToken checks that tokenString unlocks shortCode.
+func ValidateLinkToken(tokenString, shortCode string) error {
+	token, err := parseToken(tokenString, &jwt.RegisteredClaims{}, jwt.WithIssuer(tokenIssuer), jwt.WithAudience(linkUnlockAudience), jwt.WithSubject(shortCode))
+	if err != nil {
+		return err
+	}
+
+	if !token.Valid {
+		return fmt.Errorf("invalid token")
+	}
+
+	return nil
+}
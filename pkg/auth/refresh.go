@@ -0,0 +1,37 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"time"
+)
+
+// RefreshTokenTTL is how long a refresh token may go unused. Every refresh
+// replaces the token, so an active session never runs into it.
+const RefreshTokenTTL = 30 * 24 * time.Hour
+
+// NewRefreshToken returns a random opaque refresh token and the hash that is
+// stored in its place.
+func NewRefreshToken() (token, hash string, err error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+
+	token = base64.RawURLEncoding.EncodeToString(b)
+	return token, HashRefreshToken(token), nil
+}
+
+// HashRefreshToken returns the SHA-256 of token.
+func HashRefreshToken(token string) string {
+	return hashSecret(token)
+}
+
+// hashSecret hashes a random token for storage. Such tokens are random enough
+// that a fast unsalted hash is safe, and lookups stay exact.
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,82 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+var ErrTokenRevoked = errors.New("token revoked")
+
+// Revocations is the Redis denylist of access tokens that were logged out
+// before they expired. Entries only live as long as the tokens they block.
+type Revocations struct {
+	redis *redis.Client
+}
+
+func NewRevocations(redisClient *redis.Client) *Revocations {
+	return &Revocations{redis: redisClient}
+}
+
+// revocations is consulted by ValidateToken once UseRevocations is called.
+var revocations *Revocations
+
+// UseRevocations makes ValidateToken reject tokens revoked through r. Without
+// it revoked tokens stay valid until they expire.
+func UseRevocations(r *Revocations) {
+	revocations = r
+}
+
+func deniedTokenKey(tokenID string) string {
+	return fmt.Sprintf("auth:denied:%s", tokenID)
+}
+
+func revokedBeforeKey(userID string) string {
+	return fmt.Sprintf("auth:revoked_before_ms:%s", userID)
+}
+
+// RevokeToken denies one access token for the rest of its lifetime.
+func (r *Revocations) RevokeToken(ctx context.Context, claims *Claims) error {
+	ttl := AccessTokenTTL
+	if claims.ExpiresAt != nil {
+		ttl = time.Until(claims.ExpiresAt.Time)
+	}
+	if ttl <= 0 {
+		return nil
+	}
+
+	return r.redis.Set(ctx, deniedTokenKey(claims.ID), 1, ttl).Err()
+}
+
+// RevokeUser denies every access token issued to userID up to now. Tokens
+// issued later, such as after logging in again, are not affected, even
+// within the same second.
+func (r *Revocations) RevokeUser(ctx context.Context, userID string, now time.Time) error {
+	return r.redis.Set(ctx, revokedBeforeKey(userID), now.UnixMilli(), AccessTokenTTL).Err()
+}
+
+// check fails closed: a token is only accepted when Redis confirms it was
+// not revoked.
+func (r *Revocations) check(ctx context.Context, claims *Claims) error {
+	values, err := r.redis.MGet(ctx, deniedTokenKey(claims.ID), revokedBeforeKey(claims.UserID)).Result()
+	if err != nil {
+		return fmt.Errorf("checking token revocation: %w", err)
+	}
+
+	if values[0] != nil {
+		return ErrTokenRevoked
+	}
+
+	if value, ok := values[1].(string); ok {
+		revokedBefore, err := strconv.ParseInt(value, 10, 64)
+		if err == nil && claims.IssuedAtMs <= revokedBefore {
+			return ErrTokenRevoked
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,27 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+)
+
+// statsTokenPrefix tells stats tokens apart from API keys, which are sent in
+// a different place and grant far more.
+const statsTokenPrefix = "st_"
+
+// NewStatsToken returns a random token that shares a link's analytics
+// read-only, and the hash that is stored in its place.
+func NewStatsToken() (token, hash string, err error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+
+	token = statsTokenPrefix + base64.RawURLEncoding.EncodeToString(b)
+	return token, HashStatsToken(token), nil
+}
+
+// HashStatsToken returns the SHA-256 of token, like HashRefreshToken.
+func HashStatsToken(token string) string {
+	return hashSecret(token)
+}
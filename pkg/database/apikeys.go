@@ -0,0 +1,177 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+var ErrAPIKeyNotFound = errors.New("api key not found")
+
+// lastUsedPrecision is how stale last_used_at may get, so that a busy key
+// does not write to the database on every request.
+const lastUsedPrecision = time.Minute
+
+type APIKey struct {
+	ID         int64
+	UserID     string
+	Name       string
+	Prefix     string // start of the key, shown to tell keys apart
+	Scopes     []string
+	CreatedAt  int64
+	LastUsedAt int64 // 0 if never used
+}
+
+// HasScope reports whether the key allows scope.
+func (k *APIKey) HasScope(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// APIKeyDB stores users' API keys by hash only. Revoked keys are kept so that
+// their owners can still see what they were.
+type APIKeyDB struct {
+	db *sql.DB
+}
+
+func NewAPIKeyDB(connectionString string) (*APIKeyDB, error) {
+	db, err := open(connectionString)
+	if err != nil {
+		return nil, err
+	}
+
+	return &APIKeyDB{db: db}, nil
+}
+
+func (adb *APIKeyDB) Close() error {
+	return adb.db.Close()
+}
+
+const apiKeyColumns = `id, user_id, name, prefix, scopes, created_at, last_used_at`
+
+func scanAPIKey(row interface{ Scan(...interface{}) error }) (*APIKey, error) {
+	key := &APIKey{}
+	var createdAt time.Time
+	var lastUsedAt sql.NullTime
+
+	if err := row.Scan(&key.ID, &key.UserID, &key.Name, &key.Prefix, (*pq.StringArray)(&key.Scopes), &createdAt, &lastUsedAt); err != nil {
+		return nil, err
+	}
+
+	key.CreatedAt = createdAt.Unix()
+	if lastUsedAt.Valid {
+		key.LastUsedAt = lastUsedAt.Time.Unix()
+	}
+
+	return key, nil
+}
+
+// Create stores a new key of userID.
+func (adb *APIKeyDB) Create(ctx context.Context, userID, name, prefix, keyHash string, scopes []string) (*APIKey, error) {
+	query := `INSERT INTO api_keys (user_id, name, prefix, key_hash, scopes) VALUES ($1, $2, $3, $4, $5)
+		RETURNING ` + apiKeyColumns
+
+	return scanAPIKey(adb.db.QueryRowContext(ctx, query, userID, name, prefix, keyHash, pq.StringArray(scopes)))
+}
+
+// CountActive returns how many keys of userID are not revoked.
+func (adb *APIKeyDB) CountActive(ctx context.Context, userID string) (int, error) {
+	var count int
+	query := `SELECT COUNT(*) FROM api_keys WHERE user_id = $1 AND revoked_at IS NULL`
+
+	err := adb.db.QueryRowContext(ctx, query, userID).Scan(&count)
+	return count, err
+}
+
+// List returns the keys of userID that are not revoked, newest first.
+func (adb *APIKeyDB) List(ctx context.Context, userID string) ([]*APIKey, error) {
+	query := `SELECT ` + apiKeyColumns + ` FROM api_keys WHERE user_id = $1 AND revoked_at IS NULL ORDER BY created_at DESC, id DESC`
+
+	rows, err := adb.db.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []*APIKey
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, rows.Err()
+}
+
+// Authenticate returns the key with the given hash unless it was revoked.
+func (adb *APIKeyDB) Authenticate(ctx context.Context, keyHash string) (*APIKey, error) {
+	query := `SELECT ` + apiKeyColumns + ` FROM api_keys WHERE key_hash = $1 AND revoked_at IS NULL`
+
+	key, err := scanAPIKey(adb.db.QueryRowContext(ctx, query, keyHash))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrAPIKeyNotFound
+		}
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// SetScopes replaces the scopes of a key of userID.
+func (adb *APIKeyDB) SetScopes(ctx context.Context, userID string, id int64, scopes []string) (*APIKey, error) {
+	query := `UPDATE api_keys SET scopes = $3 WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL
+		RETURNING ` + apiKeyColumns
+
+	key, err := scanAPIKey(adb.db.QueryRowContext(ctx, query, id, userID, pq.StringArray(scopes)))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrAPIKeyNotFound
+		}
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// Revoke disables a key of userID for good.
+func (adb *APIKeyDB) Revoke(ctx context.Context, userID string, id int64) error {
+	query := `UPDATE api_keys SET revoked_at = CURRENT_TIMESTAMP WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL`
+
+	result, err := adb.db.ExecContext(ctx, query, id, userID)
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrAPIKeyNotFound
+	}
+
+	return nil
+}
+
+// TouchLastUsed records that key was used at now. The write is skipped when
+// the recorded time is recent enough.
+func (adb *APIKeyDB) TouchLastUsed(ctx context.Context, key *APIKey, now time.Time) error {
+	if key.LastUsedAt != 0 && now.Unix()-key.LastUsedAt < int64(lastUsedPrecision.Seconds()) {
+		return nil
+	}
+
+	query := `UPDATE api_keys SET last_used_at = $2 WHERE id = $1`
+
+	_, err := adb.db.ExecContext(ctx, query, key.ID, now.UTC())
+	return err
+}
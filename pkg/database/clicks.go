@@ -0,0 +1,225 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// Rollup periods stored in click_rollups.
+const (
+	RollupDay   = "day"
+	RollupMonth = "month"
+)
+
+const dateLayout = "2006-01-02"
+
+// RollupState records how far the analytics rollup worker has got. Dates are
+// midnights in the rollup timezone; zero values mean the tier is still empty.
+type RollupState struct {
+	FirstDay      time.Time // oldest day ever rolled up
+	DaysFrom      time.Time // oldest day still kept at day resolution
+	DaysThrough   time.Time // newest day rolled up
+	MonthsThrough time.Time // first day of the newest month rolled up
+}
+
+// ClickRollupDB keeps per-link click counts in PostgreSQL once the Redis
+// counters they were built from have expired.
+type ClickRollupDB struct {
+	db  *sql.DB
+	loc *time.Location // timezone the stored dates are days of
+}
+
+func NewClickRollupDB(connectionString string, loc *time.Location) (*ClickRollupDB, error) {
+	db, err := open(connectionString)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ClickRollupDB{db: db, loc: loc}, nil
+}
+
+func (cdb *ClickRollupDB) Close() error {
+	return cdb.db.Close()
+}
+
+func (cdb *ClickRollupDB) State(ctx context.Context) (*RollupState, error) {
+	rows, err := cdb.db.QueryContext(ctx, `SELECT name, value FROM click_rollup_state`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	state := &RollupState{}
+	for rows.Next() {
+		var name string
+		var value time.Time
+		if err := rows.Scan(&name, &value); err != nil {
+			return nil, err
+		}
+
+		switch name {
+		case "first_day":
+			state.FirstDay = cdb.localDate(value)
+		case "days_from":
+			state.DaysFrom = cdb.localDate(value)
+		case "days_through":
+			state.DaysThrough = cdb.localDate(value)
+		case "months_through":
+			state.MonthsThrough = cdb.localDate(value)
+		}
+	}
+
+	return state, rows.Err()
+}
+
+// SaveDay stores one day's per-link counts and marks the day as rolled up.
+// Saving a day again replaces its counts.
+func (cdb *ClickRollupDB) SaveDay(ctx context.Context, day time.Time, counts map[string]int64) error {
+	tx, err := cdb.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, `INSERT INTO click_rollups (short_code, period, period_start, clicks) VALUES ($1, $2, $3, $4) ON CONFLICT (short_code, period, period_start) DO UPDATE SET clicks = EXCLUDED.clicks`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	date := day.Format(dateLayout)
+	for shortCode, clicks := range counts {
+		if _, err := stmt.ExecContext(ctx, shortCode, RollupDay, date, clicks); err != nil {
+			return err
+		}
+	}
+
+	if err := initRollupState(ctx, tx, "first_day", date); err != nil {
+		return err
+	}
+	if err := initRollupState(ctx, tx, "days_from", date); err != nil {
+		return err
+	}
+	if err := advanceRollupState(ctx, tx, "days_through", date); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// RollUpMonth sums the day rows of the month starting at month into month
+// rows. Call it only once every day of the month is saved.
+func (cdb *ClickRollupDB) RollUpMonth(ctx context.Context, month time.Time) error {
+	tx, err := cdb.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `INSERT INTO click_rollups (short_code, period, period_start, clicks)
+		SELECT short_code, $1::varchar, $2::date, SUM(clicks) FROM click_rollups
+		WHERE period = $3 AND period_start >= $2::date AND period_start < $2::date + INTERVAL '1 month'
+		GROUP BY short_code
+		ON CONFLICT (short_code, period, period_start) DO UPDATE SET clicks = EXCLUDED.clicks`
+
+	date := month.Format(dateLayout)
+	if _, err := tx.ExecContext(ctx, query, RollupMonth, date, RollupDay); err != nil {
+		return err
+	}
+
+	if err := advanceRollupState(ctx, tx, "months_through", date); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// PruneDays deletes day rows before the given day. The caller must have
+// rolled up every month before it.
+func (cdb *ClickRollupDB) PruneDays(ctx context.Context, before time.Time) error {
+	tx, err := cdb.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	date := before.Format(dateLayout)
+	if _, err := tx.ExecContext(ctx, `DELETE FROM click_rollups WHERE period = $1 AND period_start < $2`, RollupDay, date); err != nil {
+		return err
+	}
+
+	if err := advanceRollupState(ctx, tx, "days_from", date); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// DeleteLink drops every rolled up count of shortCode.
+func (cdb *ClickRollupDB) DeleteLink(ctx context.Context, shortCode string) error {
+	_, err := cdb.db.ExecContext(ctx, `DELETE FROM click_rollups WHERE short_code = $1`, shortCode)
+	return err
+}
+
+// RenameLink moves the rolled up counts of shortCode to newShortCode,
+// replacing any the new code had.
+func (cdb *ClickRollupDB) RenameLink(ctx context.Context, shortCode, newShortCode string) error {
+	tx, err := cdb.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM click_rollups WHERE short_code = $1`, newShortCode); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE click_rollups SET short_code = $2 WHERE short_code = $1`, shortCode, newShortCode); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Counts returns a link's rolled up clicks for periods starting in
+// [from, to), keyed by the period's first day as YYYY-MM-DD. Periods without
+// clicks are omitted.
+func (cdb *ClickRollupDB) Counts(ctx context.Context, shortCode, period string, from, to time.Time) (map[string]int64, error) {
+	query := `SELECT period_start, clicks FROM click_rollups WHERE short_code = $1 AND period = $2 AND period_start >= $3 AND period_start < $4`
+
+	rows, err := cdb.db.QueryContext(ctx, query, shortCode, period, from.Format(dateLayout), to.Format(dateLayout))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int64)
+	for rows.Next() {
+		var start time.Time
+		var clicks int64
+		if err := rows.Scan(&start, &clicks); err != nil {
+			return nil, err
+		}
+		counts[start.Format(dateLayout)] = clicks
+	}
+
+	return counts, rows.Err()
+}
+
+func initRollupState(ctx context.Context, tx *sql.Tx, name, date string) error {
+	_, err := tx.ExecContext(ctx, `INSERT INTO click_rollup_state (name, value) VALUES ($1, $2) ON CONFLICT (name) DO NOTHING`, name, date)
+	return err
+}
+
+// advanceRollupState moves a state date forward, never back.
+func advanceRollupState(ctx context.Context, tx *sql.Tx, name, date string) error {
+	_, err := tx.ExecContext(ctx, `INSERT INTO click_rollup_state (name, value) VALUES ($1, $2) ON CONFLICT (name) DO UPDATE SET value = GREATEST(click_rollup_state.value, EXCLUDED.value)`, name, date)
+	return err
+}
+
+// localDate turns a DATE column, which the driver returns at UTC midnight,
+// into midnight of the same calendar day in the rollup timezone.
+func (cdb *ClickRollupDB) localDate(t time.Time) time.Time {
+	year, month, day := t.Date()
+	return time.Date(year, month, day, 0, 0, 0, 0, cdb.loc)
+}
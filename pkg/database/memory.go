@@ -0,0 +1,173 @@
+package database
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// MemoryURLStore keeps links in process memory. It is meant for tests and
+// local runs without PostgreSQL; nothing survives a restart.
+type MemoryURLStore struct {
+	urls   map[string]*URLData
+	byUser map[string]map[string]struct{}
+	mu     sync.RWMutex
+}
+
+func NewMemoryURLStore() *MemoryURLStore {
+	return &MemoryURLStore{
+		urls:   make(map[string]*URLData),
+		byUser: make(map[string]map[string]struct{}),
+	}
+}
+
+func (m *MemoryURLStore) Create(ctx context.Context, data *URLData) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, exists := m.urls[data.ShortCode]; exists {
+		return ErrShortCodeTaken
+	}
+
+	stored := *data
+	m.put(&stored)
+	return nil
+}
+
+func (m *MemoryURLStore) Get(ctx context.Context, shortCode string) (*URLData, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	data, exists := m.urls[shortCode]
+	if !exists {
+		return nil, ErrURLNotFound
+	}
+
+	result := *data
+	return &result, nil
+}
+
+func (m *MemoryURLStore) ListByUser(ctx context.Context, userID string, opts ListOptions) ([]*URLData, error) {
+	var less func(a, b *URLData) bool
+	switch opts.SortBy {
+	case SortByCreatedAt:
+		less = func(a, b *URLData) bool {
+			if a.CreatedAt != b.CreatedAt {
+				return a.CreatedAt > b.CreatedAt
+			}
+			return a.ShortCode < b.ShortCode
+		}
+	case SortByAlias:
+		less = func(a, b *URLData) bool {
+			return a.ShortCode < b.ShortCode
+		}
+	default:
+		return nil, ErrInvalidSort
+	}
+
+	query := strings.ToLower(opts.Query)
+
+	m.mu.RLock()
+	urls := make([]*URLData, 0, len(m.byUser[userID]))
+	for shortCode := range m.byUser[userID] {
+		data := m.urls[shortCode]
+		if query != "" &&
+			!strings.Contains(strings.ToLower(data.OriginalURL), query) &&
+			!strings.Contains(strings.ToLower(data.ShortCode), query) {
+			continue
+		}
+		result := *data
+		urls = append(urls, &result)
+	}
+	m.mu.RUnlock()
+
+	sort.Slice(urls, func(i, j int) bool {
+		return less(urls[i], urls[j])
+	})
+
+	if opts.Offset >= len(urls) {
+		return []*URLData{}, nil
+	}
+	urls = urls[opts.Offset:]
+
+	if opts.Limit > 0 && opts.Limit < len(urls) {
+		urls = urls[:opts.Limit]
+	}
+
+	return urls, nil
+}
+
+func (m *MemoryURLStore) Delete(ctx context.Context, shortCode string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	data, exists := m.urls[shortCode]
+	if !exists {
+		return ErrURLNotFound
+	}
+
+	m.remove(data)
+	return nil
+}
+
+func (m *MemoryURLStore) Update(ctx context.Context, shortCode string, data *URLData) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	existing, exists := m.urls[shortCode]
+	if !exists {
+		return ErrURLNotFound
+	}
+
+	if data.ShortCode != shortCode {
+		if _, exists := m.urls[data.ShortCode]; exists {
+			return ErrShortCodeTaken
+		}
+	}
+
+	stored := *data
+	stored.ClickCount = existing.ClickCount
+	m.remove(existing)
+	m.put(&stored)
+	return nil
+}
+
+func (m *MemoryURLStore) ConsumeClick(ctx context.Context, shortCode string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	data, exists := m.urls[shortCode]
+	if !exists {
+		return ErrURLNotFound
+	}
+
+	if data.MaxClicks > 0 && data.ClickCount >= data.MaxClicks {
+		return ErrURLExpired
+	}
+
+	data.ClickCount++
+	return nil
+}
+
+// put and remove keep the per-user index in step with urls. Callers hold mu.
+func (m *MemoryURLStore) put(data *URLData) {
+	m.urls[data.ShortCode] = data
+
+	codes, exists := m.byUser[data.UserID]
+	if !exists {
+		codes = make(map[string]struct{})
+		m.byUser[data.UserID] = codes
+	}
+	codes[data.ShortCode] = struct{}{}
+}
+
+func (m *MemoryURLStore) remove(data *URLData) {
+	delete(m.urls, data.ShortCode)
+
+	codes := m.byUser[data.UserID]
+	delete(codes, data.ShortCode)
+	if len(codes) == 0 {
+		delete(m.byUser, data.UserID)
+	}
+}
@@ -0,0 +1,20 @@
+-- Create urls table
+CREATE TABLE IF NOT EXISTS urls (
+    short_code VARCHAR(10) PRIMARY KEY,
+    original_url VARCHAR(2048) NOT NULL,
+    user_id VARCHAR(50) NOT NULL,
+    expires_at TIMESTAMP,
+    max_clicks BIGINT NOT NULL DEFAULT 0,
+    click_count BIGINT NOT NULL DEFAULT 0,
+    password_hash VARCHAR(255) NOT NULL DEFAULT '',
+    redirect_status SMALLINT NOT NULL DEFAULT 0,
+    campaign VARCHAR(100) NOT NULL DEFAULT '',
+    utm_source VARCHAR(100) NOT NULL DEFAULT '',
+    utm_medium VARCHAR(100) NOT NULL DEFAULT '',
+    stats_token_hash VARCHAR(64) NOT NULL DEFAULT '',
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Create index on user_id for listing a user's links
+CREATE INDEX IF NOT EXISTS idx_urls_user_id ON urls(user_id, created_at DESC);
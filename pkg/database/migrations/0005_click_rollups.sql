@@ -0,0 +1,13 @@
+-- Create click rollup tables for analytics older than the Redis counters
+CREATE TABLE IF NOT EXISTS click_rollups (
+    short_code VARCHAR(10) NOT NULL,
+    period VARCHAR(5) NOT NULL,
+    period_start DATE NOT NULL,
+    clicks BIGINT NOT NULL,
+    PRIMARY KEY (short_code, period, period_start)
+);
+
+CREATE TABLE IF NOT EXISTS click_rollup_state (
+    name VARCHAR(20) PRIMARY KEY,
+    value DATE NOT NULL
+);
@@ -0,0 +1,4 @@
+-- Add the admin flag; the seeded admin account is the first admin
+ALTER TABLE users ADD COLUMN IF NOT EXISTS is_admin BOOLEAN NOT NULL DEFAULT FALSE;
+
+UPDATE users SET is_admin = TRUE WHERE username = 'admin';
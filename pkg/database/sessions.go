@@ -0,0 +1,129 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+var (
+	ErrRefreshTokenInvalid = errors.New("refresh token invalid")
+	ErrRefreshTokenReused  = errors.New("refresh token reused")
+)
+
+// RefreshTokenDB stores the refresh tokens of login sessions, by hash only.
+// A session is the chain of tokens that started with one login; each refresh
+// revokes the presented token and adds its replacement to the chain. Times
+// are stored in UTC.
+type RefreshTokenDB struct {
+	db *sql.DB
+}
+
+func NewRefreshTokenDB(connectionString string) (*RefreshTokenDB, error) {
+	db, err := open(connectionString)
+	if err != nil {
+		return nil, err
+	}
+
+	return &RefreshTokenDB{db: db}, nil
+}
+
+func (rdb *RefreshTokenDB) Close() error {
+	return rdb.db.Close()
+}
+
+// Create starts a session with its first refresh token. The token's hash
+// doubles as the session ID.
+func (rdb *RefreshTokenDB) Create(ctx context.Context, userID, tokenHash string, expiresAt time.Time) error {
+	query := `INSERT INTO refresh_tokens (token_hash, user_id, session_id, expires_at) VALUES ($1, $2, $1, $3)`
+
+	_, err := rdb.db.ExecContext(ctx, query, tokenHash, userID, expiresAt.UTC())
+	return err
+}
+
+// Rotate replaces the refresh token tokenHash with nextHash in the same
+// session and returns the session's user. A token that was already replaced
+// or revoked has been used twice, which means it leaked: the whole session is
+// revoked and ErrRefreshTokenReused returned.
+func (rdb *RefreshTokenDB) Rotate(ctx context.Context, tokenHash, nextHash string, expiresAt time.Time) (string, error) {
+	tx, err := rdb.db.BeginTx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var userID, sessionID string
+	var tokenExpiresAt time.Time
+	var revokedAt sql.NullTime
+	err = tx.QueryRowContext(ctx, `SELECT user_id, session_id, expires_at, revoked_at FROM refresh_tokens WHERE token_hash = $1 FOR UPDATE`, tokenHash).
+		Scan(&userID, &sessionID, &tokenExpiresAt, &revokedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", ErrRefreshTokenInvalid
+		}
+		return "", err
+	}
+
+	if revokedAt.Valid {
+		if _, err := tx.ExecContext(ctx, `UPDATE refresh_tokens SET revoked_at = CURRENT_TIMESTAMP WHERE session_id = $1 AND revoked_at IS NULL`, sessionID); err != nil {
+			return "", err
+		}
+		if err := tx.Commit(); err != nil {
+			return "", err
+		}
+		return "", ErrRefreshTokenReused
+	}
+
+	if !time.Now().Before(tokenExpiresAt) {
+		return "", ErrRefreshTokenInvalid
+	}
+
+	if _, err := tx.ExecContext(ctx, `UPDATE refresh_tokens SET revoked_at = CURRENT_TIMESTAMP WHERE token_hash = $1`, tokenHash); err != nil {
+		return "", err
+	}
+
+	if _, err := tx.ExecContext(ctx, `INSERT INTO refresh_tokens (token_hash, user_id, session_id, expires_at) VALUES ($1, $2, $3, $4)`, nextHash, userID, sessionID, expiresAt.UTC()); err != nil {
+		return "", err
+	}
+
+	return userID, tx.Commit()
+}
+
+// RevokeSession ends the session tokenHash belongs to and returns its user.
+func (rdb *RefreshTokenDB) RevokeSession(ctx context.Context, tokenHash string) (string, error) {
+	query := `UPDATE refresh_tokens SET revoked_at = CURRENT_TIMESTAMP
+		WHERE session_id = (SELECT session_id FROM refresh_tokens WHERE token_hash = $1) AND revoked_at IS NULL
+		RETURNING user_id`
+
+	var userID string
+	err := rdb.db.QueryRowContext(ctx, query, tokenHash).Scan(&userID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", ErrRefreshTokenInvalid
+		}
+		return "", err
+	}
+
+	return userID, nil
+}
+
+// RevokeUser ends every session of userID.
+func (rdb *RefreshTokenDB) RevokeUser(ctx context.Context, userID string) error {
+	query := `UPDATE refresh_tokens SET revoked_at = CURRENT_TIMESTAMP WHERE user_id = $1 AND revoked_at IS NULL`
+
+	_, err := rdb.db.ExecContext(ctx, query, userID)
+	return err
+}
+
+// PruneExpired deletes tokens that expired before the given time and returns
+// how many there were. Revoked tokens are kept until then so that reuse is
+// still detected.
+func (rdb *RefreshTokenDB) PruneExpired(ctx context.Context, before time.Time) (int64, error) {
+	result, err := rdb.db.ExecContext(ctx, `DELETE FROM refresh_tokens WHERE expires_at < $1`, before.UTC())
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
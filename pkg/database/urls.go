@@ -0,0 +1,284 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+var (
+	ErrURLNotFound    = errors.New("url not found")
+	ErrShortCodeTaken = errors.New("short code already taken")
+	ErrURLExpired     = errors.New("url expired")
+	ErrInvalidSort    = errors.New("invalid sort field")
+)
+
+const uniqueViolation pq.ErrorCode = "23505"
+
+type URLData struct {
+	ShortCode   string
+	OriginalURL string
+	UserID      string
+	CreatedAt   int64
+	ExpiresAt   int64 // unix seconds, 0 means never
+	MaxClicks   int64 // 0 means unlimited
+	ClickCount  int64 // only counted for links with MaxClicks set
+	// PasswordHash is the bcrypt hash of the unlock passphrase, empty for
+	// public links.
+	PasswordHash string
+	// RedirectStatus is the HTTP status used for redirects, 0 means the
+	// server default.
+	RedirectStatus int32
+	// Campaign, Source and Medium tag the link for campaign analytics and
+	// the utm_* redirect parameters. All are optional.
+	Campaign string
+	Source   string
+	Medium   string
+	// StatsTokenHash is the SHA-256 of the token that shares the link's
+	// analytics read-only, empty when they are private.
+	StatsTokenHash string
+}
+
+// Expired reports whether the link's expiry time has passed.
+func (d *URLData) Expired(now time.Time) bool {
+	return d.ExpiresAt != 0 && now.Unix() >= d.ExpiresAt
+}
+
+const (
+	SortByCreatedAt = "created_at"
+	SortByAlias     = "alias"
+)
+
+// ListOptions narrows and orders ListByUser results. Newest links come first
+// when sorting by creation time; aliases sort alphabetically.
+type ListOptions struct {
+	Query  string // case-insensitive substring of the destination or short code
+	SortBy string
+	Offset int
+	Limit  int // 0 returns every match
+}
+
+// URLStore is the source of truth for short links. Redis only caches lookups
+// in front of it.
+type URLStore interface {
+	Create(ctx context.Context, data *URLData) error
+	Get(ctx context.Context, shortCode string) (*URLData, error)
+	ListByUser(ctx context.Context, userID string, opts ListOptions) ([]*URLData, error)
+	Delete(ctx context.Context, shortCode string) error
+	// Update replaces the link stored under shortCode with data. data.ShortCode
+	// may differ from shortCode to rename the link.
+	Update(ctx context.Context, shortCode string, data *URLData) error
+	// ConsumeClick atomically counts one redirect against a click-capped
+	// link and returns ErrURLExpired once MaxClicks is reached.
+	ConsumeClick(ctx context.Context, shortCode string) error
+}
+
+const urlColumns = `short_code, original_url, user_id, created_at, expires_at, max_clicks, click_count, password_hash, redirect_status, campaign, utm_source, utm_medium, stats_token_hash`
+
+var listOrderColumns = map[string]string{
+	SortByCreatedAt: "created_at DESC, short_code",
+	SortByAlias:     "short_code",
+}
+
+// URLDB stores short links. Times are stored in UTC.
+type URLDB struct {
+	db *sql.DB
+}
+
+func NewURLDB(connectionString string) (*URLDB, error) {
+	db, err := open(connectionString)
+	if err != nil {
+		return nil, err
+	}
+
+	return &URLDB{db: db}, nil
+}
+
+func (udb *URLDB) Close() error {
+	return udb.db.Close()
+}
+
+func (udb *URLDB) Create(ctx context.Context, data *URLData) error {
+	query := `INSERT INTO urls (short_code, original_url, user_id, created_at, expires_at, max_clicks, password_hash, redirect_status, campaign, utm_source, utm_medium) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)`
+
+	var expiresAt sql.NullTime
+	if data.ExpiresAt != 0 {
+		expiresAt = sql.NullTime{Time: time.Unix(data.ExpiresAt, 0).UTC(), Valid: true}
+	}
+
+	_, err := udb.db.ExecContext(ctx, query, data.ShortCode, data.OriginalURL, data.UserID, time.Unix(data.CreatedAt, 0).UTC(), expiresAt, data.MaxClicks, data.PasswordHash, data.RedirectStatus, data.Campaign, data.Source, data.Medium)
+	if err != nil {
+		if isUniqueViolation(err) {
+			return ErrShortCodeTaken
+		}
+		return err
+	}
+
+	return nil
+}
+
+func (udb *URLDB) Get(ctx context.Context, shortCode string) (*URLData, error) {
+	query := `SELECT ` + urlColumns + ` FROM urls WHERE short_code = $1`
+
+	data, err := scanURL(udb.db.QueryRowContext(ctx, query, shortCode))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrURLNotFound
+		}
+		return nil, err
+	}
+
+	return data, nil
+}
+
+func (udb *URLDB) ListByUser(ctx context.Context, userID string, opts ListOptions) ([]*URLData, error) {
+	orderBy, ok := listOrderColumns[opts.SortBy]
+	if !ok {
+		return nil, ErrInvalidSort
+	}
+
+	query := `SELECT ` + urlColumns + ` FROM urls WHERE user_id = $1`
+	args := []any{userID}
+
+	if opts.Query != "" {
+		args = append(args, "%"+escapeLike(opts.Query)+"%")
+		query += fmt.Sprintf(` AND (original_url ILIKE $%d OR short_code ILIKE $%d)`, len(args), len(args))
+	}
+
+	query += ` ORDER BY ` + orderBy
+
+	if opts.Limit > 0 {
+		args = append(args, opts.Limit)
+		query += fmt.Sprintf(` LIMIT $%d`, len(args))
+	}
+	if opts.Offset > 0 {
+		args = append(args, opts.Offset)
+		query += fmt.Sprintf(` OFFSET $%d`, len(args))
+	}
+
+	rows, err := udb.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	urls := make([]*URLData, 0)
+	for rows.Next() {
+		data, err := scanURL(rows)
+		if err != nil {
+			return nil, err
+		}
+		urls = append(urls, data)
+	}
+
+	return urls, rows.Err()
+}
+
+func (udb *URLDB) Delete(ctx context.Context, shortCode string) error {
+	query := `DELETE FROM urls WHERE short_code = $1`
+
+	result, err := udb.db.ExecContext(ctx, query, shortCode)
+	if err != nil {
+		return err
+	}
+
+	return requireAffected(result)
+}
+
+func (udb *URLDB) Update(ctx context.Context, shortCode string, data *URLData) error {
+	query := `UPDATE urls SET short_code = $1, original_url = $2, user_id = $3, redirect_status = $4, stats_token_hash = $5, expires_at = $6, max_clicks = $7, campaign = $8, utm_source = $9, utm_medium = $10, updated_at = CURRENT_TIMESTAMP WHERE short_code = $11`
+
+	var expiresAt sql.NullTime
+	if data.ExpiresAt != 0 {
+		expiresAt = sql.NullTime{Time: time.Unix(data.ExpiresAt, 0).UTC(), Valid: true}
+	}
+
+	result, err := udb.db.ExecContext(ctx, query, data.ShortCode, data.OriginalURL, data.UserID, data.RedirectStatus, data.StatsTokenHash, expiresAt, data.MaxClicks, data.Campaign, data.Source, data.Medium, shortCode)
+	if err != nil {
+		if isUniqueViolation(err) {
+			return ErrShortCodeTaken
+		}
+		return err
+	}
+
+	return requireAffected(result)
+}
+
+func (udb *URLDB) ConsumeClick(ctx context.Context, shortCode string) error {
+	query := `UPDATE urls SET click_count = click_count + 1 WHERE short_code = $1 AND (max_clicks = 0 OR click_count < max_clicks)`
+
+	result, err := udb.db.ExecContext(ctx, query, shortCode)
+	if err != nil {
+		return err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrURLExpired
+	}
+	return nil
+}
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanURL(row rowScanner) (*URLData, error) {
+	data := &URLData{}
+	var createdAt time.Time
+	var expiresAt sql.NullTime
+
+	err := row.Scan(
+		&data.ShortCode,
+		&data.OriginalURL,
+		&data.UserID,
+		&createdAt,
+		&expiresAt,
+		&data.MaxClicks,
+		&data.ClickCount,
+		&data.PasswordHash,
+		&data.RedirectStatus,
+		&data.Campaign,
+		&data.Source,
+		&data.Medium,
+		&data.StatsTokenHash,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	data.CreatedAt = createdAt.Unix()
+	if expiresAt.Valid {
+		data.ExpiresAt = expiresAt.Time.Unix()
+	}
+	return data, nil
+}
+
+func requireAffected(result sql.Result) error {
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrURLNotFound
+	}
+	return nil
+}
+
+// escapeLike makes user input match literally inside an ILIKE pattern.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+func isUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == uniqueViolation
+}
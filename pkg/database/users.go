@@ -5,7 +5,6 @@ import (
 	"errors"
 	"time"
 
-	_ "github.com/lib/pq"
 	"golang.org/x/crypto/bcrypt"
 )
 
@@ -14,6 +13,7 @@ type User struct {
 	Username     string
 	PasswordHash string
 	Email        string
+	IsAdmin      bool
 	CreatedAt    time.Time
 	UpdatedAt    time.Time
 }
@@ -23,16 +23,11 @@ type UserDB struct {
 }
 
 func NewUserDB(connectionString string) (*UserDB, error) {
-	db, err := sql.Open("postgres", connectionString)
+	db, err := open(connectionString)
 	if err != nil {
 		return nil, err
 	}
 
-	// Test connection
-	if err := db.Ping(); err != nil {
-		return nil, err
-	}
-
 	return &UserDB{db: db}, nil
 }
 
@@ -41,13 +36,13 @@ func (udb *UserDB) Close() error {
 }
 
 func (udb *UserDB) CreateUser(username, password, email string) error {
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	hashedPassword, err := HashPassword(password)
 	if err != nil {
 		return err
 	}
 
 	query := `INSERT INTO users (username, password_hash, email) VALUES ($1, $2, $3)`
-	_, err = udb.db.Exec(query, username, string(hashedPassword), email)
+	_, err = udb.db.Exec(query, username, hashedPassword, email)
 	if err != nil {
 		return err
 	}
@@ -67,12 +62,21 @@ func (udb *UserDB) ValidateUser(username, password string) (bool, error) {
 		return false, err
 	}
 
-	err = bcrypt.CompareHashAndPassword([]byte(passwordHash), []byte(password))
+	return CheckPassword(passwordHash, password), nil
+}
+
+// HashPassword returns the bcrypt hash stored for user and link passwords.
+func HashPassword(password string) (string, error) {
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 	if err != nil {
-		return false, nil
+		return "", err
 	}
+	return string(hashedPassword), nil
+}
 
-	return true, nil
+// CheckPassword reports whether password matches a hash from HashPassword.
+func CheckPassword(passwordHash, password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(passwordHash), []byte(password)) == nil
 }
 
 func (udb *UserDB) UserExists(username string) (bool, error) {
@@ -87,15 +91,32 @@ func (udb *UserDB) UserExists(username string) (bool, error) {
 	return exists, nil
 }
 
+// IsAdmin reports whether username may use the admin endpoints.
+func (udb *UserDB) IsAdmin(username string) (bool, error) {
+	var isAdmin bool
+	query := `SELECT is_admin FROM users WHERE username = $1`
+
+	err := udb.db.QueryRow(query, username).Scan(&isAdmin)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return isAdmin, nil
+}
+
 func (udb *UserDB) GetUser(username string) (*User, error) {
 	user := &User{}
-	query := `SELECT id, username, password_hash, email, created_at, updated_at FROM users WHERE username = $1`
+	query := `SELECT id, username, password_hash, email, is_admin, created_at, updated_at FROM users WHERE username = $1`
 
 	err := udb.db.QueryRow(query, username).Scan(
 		&user.ID,
 		&user.Username,
 		&user.PasswordHash,
 		&user.Email,
+		&user.IsAdmin,
 		&user.CreatedAt,
 		&user.UpdatedAt,
 	)
@@ -0,0 +1,44 @@
+package geoip
+
+import "net"
+
+// Location is the part of a GeoIP2/GeoLite2 City or Country record the
+// analytics use. Fields the database has no value for are empty.
+type Location struct {
+	CountryCode string // ISO 3166-1 alpha-2
+	Country     string // English name
+	City        string // English name
+}
+
+// Locate returns where ip is, or an empty Location when the database does
+// not know.
+func (r *Reader) Locate(ip net.IP) (*Location, error) {
+	record, err := r.Lookup(ip)
+	if err != nil {
+		return nil, err
+	}
+
+	country := field(record, "country")
+	if country == nil {
+		country = field(record, "registered_country")
+	}
+
+	return &Location{
+		CountryCode: stringField(country, "iso_code"),
+		Country:     stringField(field(country, "names"), "en"),
+		City:        stringField(field(field(record, "city"), "names"), "en"),
+	}, nil
+}
+
+func field(value any, key string) any {
+	m, ok := value.(map[string]any)
+	if !ok {
+		return nil
+	}
+	return m[key]
+}
+
+func stringField(value any, key string) string {
+	s, _ := field(value, key).(string)
+	return s
+}
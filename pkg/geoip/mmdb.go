@@ -0,0 +1,365 @@
+package geoip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os"
+)
+
+// metadataMarker precedes the metadata map at the end of every MaxMind DB
+// file.
+var metadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// dataSectionSeparator is the run of zero bytes between the search tree and
+// the data section.
+const dataSectionSeparator = 16
+
+var ErrInvalidDatabase = errors.New("invalid MaxMind database")
+
+// Reader looks up IP addresses in a MaxMind DB (.mmdb) file, such as
+// GeoLite2-City, held entirely in memory. It never touches the network and is
+// safe for concurrent use.
+type Reader struct {
+	buf        []byte
+	data       []byte
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+	ipv4Start  uint
+}
+
+func Open(path string) (*Reader, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return New(buf)
+}
+
+// New parses a database already read into memory.
+func New(buf []byte) (*Reader, error) {
+	markerAt := bytes.LastIndex(buf, metadataMarker)
+	if markerAt == -1 {
+		return nil, fmt.Errorf("%w: metadata not found", ErrInvalidDatabase)
+	}
+
+	metaDecoder := &decoder{buf: buf[markerAt+len(metadataMarker):]}
+	raw, _, err := metaDecoder.decode(0)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidDatabase, err)
+	}
+	metadata, ok := raw.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("%w: metadata is not a map", ErrInvalidDatabase)
+	}
+
+	r := &Reader{
+		buf:        buf,
+		nodeCount:  metadataUint(metadata, "node_count"),
+		recordSize: metadataUint(metadata, "record_size"),
+		ipVersion:  metadataUint(metadata, "ip_version"),
+	}
+
+	switch r.recordSize {
+	case 24, 28, 32:
+	default:
+		return nil, fmt.Errorf("%w: unsupported record size %d", ErrInvalidDatabase, r.recordSize)
+	}
+
+	treeSize := r.nodeCount * r.recordSize / 4
+	if treeSize+dataSectionSeparator > uint(markerAt) {
+		return nil, fmt.Errorf("%w: search tree overruns file", ErrInvalidDatabase)
+	}
+	r.data = buf[treeSize+dataSectionSeparator : markerAt]
+
+	// IPv4 addresses live under ::/96 in IPv6 databases.
+	if r.ipVersion == 6 {
+		node := uint(0)
+		for i := 0; i < 96 && node < r.nodeCount; i++ {
+			node = r.readRecord(node, 0)
+		}
+		r.ipv4Start = node
+	}
+
+	return r, nil
+}
+
+// Lookup returns the record stored for ip, decoded into maps, slices, strings
+// and numbers, or nil when the database has no entry for it.
+func (r *Reader) Lookup(ip net.IP) (any, error) {
+	node, bits, err := r.startNode(ip)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := 0; i < len(bits)*8 && node < r.nodeCount; i++ {
+		bit := uint(bits[i/8]>>(7-uint(i%8))) & 1
+		node = r.readRecord(node, bit)
+	}
+
+	switch {
+	case node == r.nodeCount:
+		return nil, nil
+	case node < r.nodeCount:
+		return nil, fmt.Errorf("%w: search tree too deep", ErrInvalidDatabase)
+	}
+
+	offset := node - r.nodeCount - dataSectionSeparator
+	d := &decoder{buf: r.data}
+	value, _, err := d.decode(offset)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidDatabase, err)
+	}
+	return value, nil
+}
+
+func (r *Reader) startNode(ip net.IP) (uint, []byte, error) {
+	if ipv4 := ip.To4(); ipv4 != nil {
+		if r.ipVersion == 6 {
+			return r.ipv4Start, ipv4, nil
+		}
+		return 0, ipv4, nil
+	}
+
+	ipv6 := ip.To16()
+	if ipv6 == nil {
+		return 0, nil, fmt.Errorf("invalid IP address")
+	}
+	if r.ipVersion != 6 {
+		return 0, nil, fmt.Errorf("IPv6 lookup in an IPv4-only database")
+	}
+	return 0, ipv6, nil
+}
+
+// readRecord returns the left (bit 0) or right (bit 1) record of a node.
+func (r *Reader) readRecord(node, bit uint) uint {
+	switch r.recordSize {
+	case 24:
+		offset := node*6 + bit*3
+		b := r.buf[offset : offset+3]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		b := r.buf[node*7 : node*7+7]
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		offset := node*8 + bit*4
+		return uint(binary.BigEndian.Uint32(r.buf[offset : offset+4]))
+	}
+}
+
+func metadataUint(metadata map[string]any, key string) uint {
+	value, _ := metadata[key].(uint64)
+	return uint(value)
+}
+
+// Data section field types.
+const (
+	typeExtended = iota
+	typePointer
+	typeString
+	typeDouble
+	typeBytes
+	typeUint16
+	typeUint32
+	typeMap
+	typeInt32
+	typeUint64
+	typeUint128
+	typeArray
+	typeContainer
+	typeEndMarker
+	typeBool
+	typeFloat
+)
+
+// decoder reads values from a MaxMind DB data section. Pointers are offsets
+// into the same buffer.
+type decoder struct {
+	buf []byte
+}
+
+// maxDecodeDepth bounds how deeply pointers, maps and arrays may nest. Real
+// records are a few levels deep; a pointer cycle in a corrupt file would
+// otherwise recurse until the stack overflows.
+const maxDecodeDepth = 32
+
+var (
+	errTruncated = errors.New("data section truncated")
+	errTooDeep   = fmt.Errorf("data nested more than %d levels deep", maxDecodeDepth)
+)
+
+// decode returns the value at offset and the offset just past it.
+func (d *decoder) decode(offset uint) (any, uint, error) {
+	return d.decodeAt(offset, 0)
+}
+
+func (d *decoder) decodeAt(offset uint, depth int) (any, uint, error) {
+	if depth > maxDecodeDepth {
+		return nil, 0, errTooDeep
+	}
+	if offset >= uint(len(d.buf)) {
+		return nil, 0, errTruncated
+	}
+
+	ctrl := d.buf[offset]
+	offset++
+	kind := uint(ctrl >> 5)
+
+	if kind == typePointer {
+		target, next, err := d.pointer(ctrl, offset)
+		if err != nil {
+			return nil, 0, err
+		}
+		value, _, err := d.decodeAt(target, depth+1)
+		return value, next, err
+	}
+
+	if kind == typeExtended {
+		if offset >= uint(len(d.buf)) {
+			return nil, 0, errTruncated
+		}
+		kind = 7 + uint(d.buf[offset])
+		offset++
+	}
+
+	size, offset, err := d.size(ctrl, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	switch kind {
+	case typeMap:
+		m := make(map[string]any, size)
+		for i := uint(0); i < size; i++ {
+			key, next, err := d.decodeAt(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			name, ok := key.(string)
+			if !ok {
+				return nil, 0, fmt.Errorf("map key is not a string")
+			}
+			value, next, err := d.decodeAt(next, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			m[name] = value
+			offset = next
+		}
+		return m, offset, nil
+	case typeArray:
+		a := make([]any, 0, size)
+		for i := uint(0); i < size; i++ {
+			value, next, err := d.decodeAt(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			a = append(a, value)
+			offset = next
+		}
+		return a, offset, nil
+	case typeBool:
+		return size != 0, offset, nil
+	}
+
+	if offset+size > uint(len(d.buf)) {
+		return nil, 0, errTruncated
+	}
+	raw := d.buf[offset : offset+size]
+	next := offset + size
+
+	switch kind {
+	case typeString:
+		return string(raw), next, nil
+	case typeBytes:
+		return append([]byte(nil), raw...), next, nil
+	case typeDouble:
+		if size != 8 {
+			return nil, 0, fmt.Errorf("double of size %d", size)
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(raw)), next, nil
+	case typeFloat:
+		if size != 4 {
+			return nil, 0, fmt.Errorf("float of size %d", size)
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(raw))), next, nil
+	case typeUint16, typeUint32, typeUint64:
+		var v uint64
+		for _, b := range raw {
+			v = v<<8 | uint64(b)
+		}
+		return v, next, nil
+	case typeInt32:
+		var v uint32
+		for _, b := range raw {
+			v = v<<8 | uint32(b)
+		}
+		return int64(int32(v)), next, nil
+	case typeUint128:
+		// Not used by the geolocation databases; kept as raw bytes.
+		return append([]byte(nil), raw...), next, nil
+	default:
+		return nil, 0, fmt.Errorf("unsupported data type %d", kind)
+	}
+}
+
+// size reads the payload size encoded in the control byte and the bytes that
+// may follow it.
+func (d *decoder) size(ctrl byte, offset uint) (uint, uint, error) {
+	size := uint(ctrl & 0x1f)
+	if size < 29 {
+		return size, offset, nil
+	}
+
+	extra := size - 28
+	if offset+extra > uint(len(d.buf)) {
+		return 0, 0, errTruncated
+	}
+
+	var v uint
+	for _, b := range d.buf[offset : offset+extra] {
+		v = v<<8 | uint(b)
+	}
+
+	switch size {
+	case 29:
+		return 29 + v, offset + extra, nil
+	case 30:
+		return 285 + v, offset + extra, nil
+	default:
+		return 65821 + v, offset + extra, nil
+	}
+}
+
+// pointer returns the data section offset a pointer refers to and the
+// offset just past the pointer itself.
+func (d *decoder) pointer(ctrl byte, offset uint) (uint, uint, error) {
+	length := uint(ctrl>>3&0x3) + 1
+	if offset+length > uint(len(d.buf)) {
+		return 0, 0, errTruncated
+	}
+
+	var v uint
+	if length < 4 {
+		v = uint(ctrl & 0x7)
+	}
+	for _, b := range d.buf[offset : offset+length] {
+		v = v<<8 | uint(b)
+	}
+
+	switch length {
+	case 2:
+		v += 2048
+	case 3:
+		v += 526336
+	}
+
+	return v, offset + length, nil
+}
@@ -0,0 +1,77 @@
+package geoip
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestLocateRecordSizes(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want Location
+	}{
+		{"81.2.69.160", Location{CountryCode: "GB", Country: "United Kingdom", City: "London"}},
+		{"::ffff:81.2.69.160", Location{CountryCode: "GB", Country: "United Kingdom", City: "London"}},
+		{"1.2.3.4", Location{CountryCode: "US", Country: "United States"}},
+		{"2001:db8::1", Location{CountryCode: "GB", Country: "United Kingdom"}},
+		{"10.0.0.1", Location{}},
+		{"2001:db9::1", Location{}},
+	}
+
+	for _, size := range []int{24, 28, 32} {
+		r, err := Open(fixturePath(size))
+		if err != nil {
+			t.Fatalf("open %d-bit database: %v", size, err)
+		}
+		for _, tt := range tests {
+			got, err := r.Locate(net.ParseIP(tt.ip))
+			if err != nil {
+				t.Errorf("%d-bit: Locate(%s): %v", size, tt.ip, err)
+				continue
+			}
+			if *got != tt.want {
+				t.Errorf("%d-bit: Locate(%s) = %+v, want %+v", size, tt.ip, *got, tt.want)
+			}
+		}
+	}
+}
+
+func TestLookupMiss(t *testing.T) {
+	r, err := Open(fixturePath(24))
+	if err != nil {
+		t.Fatal(err)
+	}
+	record, err := r.Lookup(net.ParseIP("10.0.0.1"))
+	if err != nil || record != nil {
+		t.Fatalf("Lookup(10.0.0.1) = %v, %v; want nil, nil", record, err)
+	}
+}
+
+func TestLookupPointerCycle(t *testing.T) {
+	tests := []struct {
+		name  string
+		value []byte
+	}{
+		{"pointer to itself", encodePointer(0)},
+		{"map holding a pointer to itself", encodeMap("country", encodePointer(0))},
+	}
+
+	for _, tt := range tests {
+		db := newTestDatabase()
+		db.insert(t, "81.2.69.0/24", db.add(tt.value))
+		r, err := New(db.bytes(24))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if _, err := r.Lookup(net.ParseIP("81.2.69.160")); !errors.Is(err, ErrInvalidDatabase) {
+			t.Errorf("%s: Lookup error = %v, want ErrInvalidDatabase", tt.name, err)
+		}
+	}
+}
+
+func TestNewRejectsGarbage(t *testing.T) {
+	if _, err := New([]byte("not a database")); !errors.Is(err, ErrInvalidDatabase) {
+		t.Fatalf("New error = %v, want ErrInvalidDatabase", err)
+	}
+}
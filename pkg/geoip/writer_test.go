@@ -0,0 +1,210 @@
+package geoip
+
+import (
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the databases in testdata")
+
+// testDatabase builds small MaxMind DB files: an IPv6 search tree over a data
+// section the caller encodes with the append helpers below.
+type testDatabase struct {
+	nodes []treeNode
+	data  []byte
+}
+
+type recordKind int
+
+const (
+	recordEmpty recordKind = iota
+	recordNode
+	recordData
+)
+
+type record struct {
+	kind  recordKind
+	value int
+}
+
+type treeNode [2]record
+
+func newTestDatabase() *testDatabase {
+	return &testDatabase{nodes: []treeNode{{}}}
+}
+
+// add appends an encoded value to the data section and returns its offset.
+func (db *testDatabase) add(value []byte) int {
+	offset := len(db.data)
+	db.data = append(db.data, value...)
+	return offset
+}
+
+// insert points the network at the value stored at dataOffset. IPv4 networks
+// go under ::/96, where the reader looks for them.
+func (db *testDatabase) insert(t *testing.T, cidr string, dataOffset int) {
+	t.Helper()
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		t.Fatalf("parse %q: %v", cidr, err)
+	}
+	bits := []byte(network.IP)
+	prefix, _ := network.Mask.Size()
+	if len(bits) == net.IPv4len {
+		bits = append(make([]byte, 12), bits...)
+		prefix += 96
+	}
+
+	n := 0
+	for i := 0; i < prefix; i++ {
+		bit := bits[i/8] >> (7 - i%8) & 1
+		if i == prefix-1 {
+			db.nodes[n][bit] = record{kind: recordData, value: dataOffset}
+			return
+		}
+		if db.nodes[n][bit].kind != recordNode {
+			db.nodes = append(db.nodes, treeNode{})
+			db.nodes[n][bit] = record{kind: recordNode, value: len(db.nodes) - 1}
+		}
+		n = db.nodes[n][bit].value
+	}
+}
+
+// bytes lays out the tree with the given record size, the data section and the
+// metadata.
+func (db *testDatabase) bytes(recordSize int) []byte {
+	nodeCount := len(db.nodes)
+	value := func(r record) uint32 {
+		switch r.kind {
+		case recordNode:
+			return uint32(r.value)
+		case recordData:
+			return uint32(nodeCount + dataSectionSeparator + r.value)
+		}
+		return uint32(nodeCount)
+	}
+
+	var out []byte
+	for _, node := range db.nodes {
+		left, right := value(node[0]), value(node[1])
+		switch recordSize {
+		case 24:
+			out = append(out, byte(left>>16), byte(left>>8), byte(left),
+				byte(right>>16), byte(right>>8), byte(right))
+		case 28:
+			out = append(out, byte(left>>16), byte(left>>8), byte(left),
+				byte(left>>24&0x0f)<<4|byte(right>>24&0x0f),
+				byte(right>>16), byte(right>>8), byte(right))
+		case 32:
+			out = binary.BigEndian.AppendUint32(out, left)
+			out = binary.BigEndian.AppendUint32(out, right)
+		default:
+			panic(fmt.Sprintf("unsupported record size %d", recordSize))
+		}
+	}
+	out = append(out, make([]byte, dataSectionSeparator)...)
+	out = append(out, db.data...)
+	out = append(out, metadataMarker...)
+	return append(out, encodeMap(
+		"binary_format_major_version", encodeUint(typeUint16, 2),
+		"binary_format_minor_version", encodeUint(typeUint16, 0),
+		"database_type", encodeString("GeoIP2-City-Test"),
+		"ip_version", encodeUint(typeUint16, 6),
+		"node_count", encodeUint(typeUint32, uint64(nodeCount)),
+		"record_size", encodeUint(typeUint16, uint64(recordSize)),
+	)...)
+}
+
+func encodeString(s string) []byte {
+	if len(s) >= 29 {
+		panic("long strings are not supported")
+	}
+	return append([]byte{typeString<<5 | byte(len(s))}, s...)
+}
+
+// encodeMap encodes alternating string keys and already encoded values.
+func encodeMap(pairs ...any) []byte {
+	out := []byte{typeMap<<5 | byte(len(pairs)/2)}
+	for i := 0; i < len(pairs); i += 2 {
+		out = append(out, encodeString(pairs[i].(string))...)
+		out = append(out, pairs[i+1].([]byte)...)
+	}
+	return out
+}
+
+func encodeUint(typ byte, v uint64) []byte {
+	var payload []byte
+	for ; v > 0; v >>= 8 {
+		payload = append([]byte{byte(v)}, payload...)
+	}
+	if typ > 7 {
+		// Types past 7 need the extended form.
+		return append([]byte{byte(len(payload)), typ - 7}, payload...)
+	}
+	return append([]byte{typ<<5 | byte(len(payload))}, payload...)
+}
+
+// encodePointer encodes the two-byte pointer form, enough for offsets below
+// 2048.
+func encodePointer(offset int) []byte {
+	return []byte{typePointer<<5 | byte(offset>>8&0x07), byte(offset)}
+}
+
+// cityFixture fills db with the records the testdata databases hold. The
+// 2001:db8::/32 record reaches its country through a pointer, the way the
+// MaxMind writer deduplicates repeated values.
+func cityFixture(t *testing.T) *testDatabase {
+	t.Helper()
+	db := newTestDatabase()
+
+	gbCountry := encodeMap(
+		"iso_code", encodeString("GB"),
+		"names", encodeMap("en", encodeString("United Kingdom")),
+	)
+	london := db.add(encodeMap(
+		"city", encodeMap("names", encodeMap("en", encodeString("London"))),
+		"country", gbCountry,
+	))
+	// The country map is the record's last value, so it ends where the
+	// record does.
+	gbOffset := london + len(db.data[london:]) - len(gbCountry)
+
+	unitedStates := db.add(encodeMap(
+		"country", encodeMap(
+			"iso_code", encodeString("US"),
+			"names", encodeMap("en", encodeString("United States")),
+		),
+	))
+	documentation := db.add(encodeMap(
+		"registered_country", encodePointer(gbOffset),
+	))
+
+	db.insert(t, "81.2.69.0/24", london)
+	db.insert(t, "1.2.3.0/24", unitedStates)
+	db.insert(t, "2001:db8::/32", documentation)
+	return db
+}
+
+func fixturePath(recordSize int) string {
+	return filepath.Join("testdata", fmt.Sprintf("GeoIP2-City-Test-%d.mmdb", recordSize))
+}
+
+// TestWriteFixtures regenerates the testdata databases:
+//
+//	go test ./pkg/geoip -run TestWriteFixtures -update
+func TestWriteFixtures(t *testing.T) {
+	if !*update {
+		t.Skip("run with -update to rewrite testdata")
+	}
+	db := cityFixture(t)
+	for _, size := range []int{24, 28, 32} {
+		if err := os.WriteFile(fixturePath(size), db.bytes(size), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,310 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorgio/network/pkg/auth"
+	"github.com/gorgio/network/pkg/database"
+	"github.com/gorgio/network/pkg/validator"
+)
+
+// How the caller of a request proved who they are.
+const (
+	AuthJWT    = "jwt"
+	AuthAPIKey = "api_key"
+)
+
+// Claims identify the caller of a request. Authenticator puts them in the
+// request context and ForwardClaims passes them on to the gRPC backends.
+type Claims struct {
+	UserID string
+	Admin  bool
+	Method string   // AuthJWT or AuthAPIKey
+	Scopes []string // scopes of the API key; a JWT allows every scope
+
+	// Token is the access token the claims came from. It is only set on
+	// the gateway, for requests authenticated with a JWT.
+	Token *auth.Claims
+}
+
+// HasScope reports whether the caller may act within scope.
+func (c *Claims) HasScope(scope string) bool {
+	if c.Method == AuthJWT {
+		return true
+	}
+
+	for _, s := range c.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+type claimsKey struct{}
+
+// WithClaims returns a copy of ctx carrying claims.
+func WithClaims(ctx context.Context, claims *Claims) context.Context {
+	return context.WithValue(ctx, claimsKey{}, claims)
+}
+
+// ClaimsFromContext returns the caller's claims, or nil for anonymous
+// requests.
+func ClaimsFromContext(ctx context.Context) *Claims {
+	claims, _ := ctx.Value(claimsKey{}).(*Claims)
+	return claims
+}
+
+// Access is what a route requires of its callers.
+type Access int
+
+const (
+	AccessPublic        Access = iota // anyone; credentials are read if valid
+	AccessAuthenticated               // any signed-in user
+	AccessOwner                       // the owner of the short code, or an admin
+	AccessAdmin                       // an admin, signed in with a JWT
+)
+
+type Requirement struct {
+	Access Access
+	// Scope is what an API key needs for the route. Without one, only JWTs
+	// are accepted.
+	Scope string
+	// Code finds the short code of an AccessOwner route in the request.
+	Code func(r *http.Request) string
+}
+
+func Public() Requirement {
+	return Requirement{Access: AccessPublic}
+}
+
+// Optional lets anyone through like Public, but also reads API keys with
+// scope, for routes whose backend decides what each caller may see.
+func Optional(scope string) Requirement {
+	return Requirement{Access: AccessPublic, Scope: scope}
+}
+
+func Authenticated(scope string) Requirement {
+	return Requirement{Access: AccessAuthenticated, Scope: scope}
+}
+
+func OwnerOfCode(scope string, code func(r *http.Request) string) Requirement {
+	return Requirement{Access: AccessOwner, Scope: scope, Code: code}
+}
+
+func Admin() Requirement {
+	return Requirement{Access: AccessAdmin}
+}
+
+// CodeFromQuery reads the short code of the ?code= query parameter.
+func CodeFromQuery(r *http.Request) string {
+	return r.URL.Query().Get("code")
+}
+
+var (
+	ErrCodeNotFound = errors.New("short code not found")
+	ErrNotOwner     = errors.New("short code belongs to another user")
+)
+
+// OwnerCheck returns nil if userID owns shortCode, ErrCodeNotFound or
+// ErrNotOwner if not, and other errors if it could not tell.
+type OwnerCheck func(ctx context.Context, shortCode, userID string) error
+
+// Authenticator checks the credentials of requests against the requirement
+// of their route. Credentials are a Bearer JWT, or an API key sent as
+// "Authorization: ApiKey <key>" or in X-API-Key.
+type Authenticator struct {
+	apiKeys       *database.APIKeyDB
+	apiKeyLimiter *RateLimiter
+	ownerCheck    OwnerCheck
+}
+
+func NewAuthenticator(apiKeys *database.APIKeyDB, apiKeyLimiter *RateLimiter, ownerCheck OwnerCheck) *Authenticator {
+	return &Authenticator{
+		apiKeys:       apiKeys,
+		apiKeyLimiter: apiKeyLimiter,
+		ownerCheck:    ownerCheck,
+	}
+}
+
+// authError is a rejected request and the response it gets.
+type authError struct {
+	status  int
+	message string
+}
+
+// Require serves next only to callers that meet req, with their claims in
+// the request context.
+func (a *Authenticator) Require(req Requirement, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, authErr := a.authenticate(w, r, req.Scope)
+		if authErr != nil {
+			if req.Access == AccessPublic {
+				next.ServeHTTP(w, r)
+				return
+			}
+			http.Error(w, authErr.message, authErr.status)
+			return
+		}
+
+		if claims != nil {
+			r = r.WithContext(WithClaims(r.Context(), claims))
+		}
+
+		switch req.Access {
+		case AccessAuthenticated:
+			if claims == nil {
+				http.Error(w, "Authorization header required", http.StatusUnauthorized)
+				return
+			}
+		case AccessOwner:
+			if claims == nil {
+				http.Error(w, "Authorization header required", http.StatusUnauthorized)
+				return
+			}
+			if authErr := a.checkOwner(r, req.Code(r), claims); authErr != nil {
+				http.Error(w, authErr.message, authErr.status)
+				return
+			}
+		case AccessAdmin:
+			if claims == nil {
+				http.Error(w, "Authorization header required", http.StatusUnauthorized)
+				return
+			}
+			if !claims.Admin {
+				http.Error(w, "Admin access required", http.StatusForbidden)
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// authenticate reads the request's credentials. It returns no claims and no
+// error for requests without any.
+func (a *Authenticator) authenticate(w http.ResponseWriter, r *http.Request, scope string) (*Claims, *authError) {
+	if key := apiKeyFromRequest(r); key != "" {
+		if scope == "" {
+			return nil, &authError{http.StatusUnauthorized, "API keys are not accepted here"}
+		}
+		return a.authenticateAPIKey(w, r.Context(), key, scope)
+	}
+
+	authHeader := r.Header.Get("Authorization")
+	if authHeader == "" {
+		return nil, nil
+	}
+
+	token, err := auth.ValidateToken(strings.TrimPrefix(authHeader, "Bearer "))
+	if err != nil {
+		return nil, &authError{http.StatusUnauthorized, "Invalid token"}
+	}
+
+	return &Claims{
+		UserID: token.UserID,
+		Admin:  token.Admin,
+		Method: AuthJWT,
+		Token:  token,
+	}, nil
+}
+
+// apiKeyFromRequest returns the API key sent as "Authorization: ApiKey <key>"
+// or in X-API-Key, if any.
+func apiKeyFromRequest(r *http.Request) string {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return key
+	}
+
+	if authHeader := r.Header.Get("Authorization"); strings.HasPrefix(authHeader, "ApiKey ") {
+		return strings.TrimPrefix(authHeader, "ApiKey ")
+	}
+
+	return ""
+}
+
+// authenticateAPIKey checks the key, its scope and its rate limit, and
+// records its use.
+func (a *Authenticator) authenticateAPIKey(w http.ResponseWriter, ctx context.Context, key, scope string) (*Claims, *authError) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	apiKey, err := a.apiKeys.Authenticate(ctx, auth.HashAPIKey(key))
+	if err != nil {
+		if errors.Is(err, database.ErrAPIKeyNotFound) {
+			return nil, &authError{http.StatusUnauthorized, "Invalid API key"}
+		}
+		log.Printf("Error checking API key: %v", err)
+		return nil, &authError{http.StatusInternalServerError, "Internal server error"}
+	}
+
+	if !apiKey.HasScope(scope) {
+		return nil, &authError{http.StatusForbidden, fmt.Sprintf("API key lacks the %s scope", scope)}
+	}
+
+	count, err := a.apiKeyLimiter.Hit(ctx, strconv.FormatInt(apiKey.ID, 10))
+	if err != nil {
+		return nil, &authError{http.StatusInternalServerError, "Internal server error"}
+	}
+
+	limit := a.apiKeyLimiter.Limit()
+	w.Header().Set("X-RateLimit-Limit", strconv.Itoa(limit))
+	if count > int64(limit) {
+		w.Header().Set("X-RateLimit-Remaining", "0")
+		return nil, &authError{http.StatusTooManyRequests, "Rate limit exceeded"}
+	}
+	w.Header().Set("X-RateLimit-Remaining", strconv.FormatInt(int64(limit)-count, 10))
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		if err := a.apiKeys.TouchLastUsed(ctx, apiKey, time.Now()); err != nil {
+			log.Printf("Error recording use of API key %d: %v", apiKey.ID, err)
+		}
+	}()
+
+	return &Claims{
+		UserID: apiKey.UserID,
+		Method: AuthAPIKey,
+		Scopes: apiKey.Scopes,
+	}, nil
+}
+
+// checkOwner lets admins and the owner of shortCode through.
+func (a *Authenticator) checkOwner(r *http.Request, shortCode string, claims *Claims) *authError {
+	if shortCode == "" {
+		return &authError{http.StatusBadRequest, "Short code required"}
+	}
+
+	if err := validator.ValidateShortCode(shortCode); err != nil {
+		return &authError{http.StatusBadRequest, "Invalid short code"}
+	}
+
+	if claims.Admin {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	err := a.ownerCheck(ctx, shortCode, claims.UserID)
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, ErrCodeNotFound):
+		return &authError{http.StatusNotFound, "Short URL not found"}
+	case errors.Is(err, ErrNotOwner):
+		return &authError{http.StatusForbidden, "Short URL belongs to another user"}
+	default:
+		log.Printf("Error checking owner of %s: %v", shortCode, err)
+		return &authError{http.StatusInternalServerError, "Failed to check link owner"}
+	}
+}
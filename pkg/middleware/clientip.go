@@ -0,0 +1,80 @@
+package middleware
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// trustedProxies are the networks whose X-Forwarded-For and X-Real-IP headers
+// are believed. Anyone else could put any address there.
+var trustedProxies []*net.IPNet
+
+// UseTrustedProxies sets the proxies allowed to report the client address,
+// as a comma-separated list of IP addresses and CIDR ranges. An empty list
+// trusts none, and the connection's address is the client's.
+func UseTrustedProxies(list string) error {
+	var nets []*net.IPNet
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			if ip := net.ParseIP(entry); ip != nil && ip.To4() != nil {
+				entry += "/32"
+			} else {
+				entry += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return fmt.Errorf("invalid trusted proxy %q: %w", entry, err)
+		}
+		nets = append(nets, network)
+	}
+
+	trustedProxies = nets
+	return nil
+}
+
+func isTrustedProxy(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP returns the address of the client that sent r. Forwarding headers
+// only count when the connection comes from a trusted proxy, and then the
+// client is the last X-Forwarded-For hop that is not itself a trusted proxy.
+func ClientIP(r *http.Request) string {
+	addr := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	if !isTrustedProxy(addr) {
+		return addr
+	}
+
+	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+		hops := strings.Split(xff, ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			if i == 0 || !isTrustedProxy(hop) {
+				return hop
+			}
+		}
+	}
+	if xri := strings.TrimSpace(r.Header.Get("X-Real-IP")); xri != "" {
+		return xri
+	}
+	return addr
+}
@@ -0,0 +1,77 @@
+package middleware
+
+import (
+	"context"
+	"strconv"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// Metadata keys that carry the caller's claims to the gRPC backends. The
+// backends trust them because only the gateway can reach them.
+const (
+	metadataUserID = "x-user-id"
+	metadataAdmin  = "x-user-admin"
+	metadataMethod = "x-auth-method"
+	metadataScopes = "x-auth-scopes"
+)
+
+// outgoingClaims adds the claims of ctx, if any, to its outgoing metadata.
+func outgoingClaims(ctx context.Context) context.Context {
+	claims := ClaimsFromContext(ctx)
+	if claims == nil {
+		return ctx
+	}
+
+	pairs := []string{
+		metadataUserID, claims.UserID,
+		metadataAdmin, strconv.FormatBool(claims.Admin),
+		metadataMethod, claims.Method,
+	}
+	for _, scope := range claims.Scopes {
+		pairs = append(pairs, metadataScopes, scope)
+	}
+
+	return metadata.AppendToOutgoingContext(ctx, pairs...)
+}
+
+// ForwardClaims returns the client interceptors that send the caller's
+// claims along with every call made with a request's context.
+func ForwardClaims() []grpc.DialOption {
+	return []grpc.DialOption{
+		grpc.WithChainUnaryInterceptor(func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+			return invoker(outgoingClaims(ctx), method, req, reply, cc, opts...)
+		}),
+		grpc.WithChainStreamInterceptor(func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+			return streamer(outgoingClaims(ctx), desc, cc, method, opts...)
+		}),
+	}
+}
+
+// ClaimsFromIncoming returns the claims the gateway forwarded with a call,
+// or nil for calls made without a caller.
+func ClaimsFromIncoming(ctx context.Context) *Claims {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return nil
+	}
+
+	userIDs := md.Get(metadataUserID)
+	if len(userIDs) == 0 || userIDs[0] == "" {
+		return nil
+	}
+
+	claims := &Claims{
+		UserID: userIDs[0],
+		Scopes: md.Get(metadataScopes),
+	}
+	if values := md.Get(metadataAdmin); len(values) > 0 {
+		claims.Admin, _ = strconv.ParseBool(values[0])
+	}
+	if values := md.Get(metadataMethod); len(values) > 0 {
+		claims.Method = values[0]
+	}
+
+	return claims
+}
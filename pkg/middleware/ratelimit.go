@@ -4,42 +4,44 @@ import (
 	"context"
 	"fmt"
 	"net/http"
-	"strings"
 	"time"
 
 	"github.com/redis/go-redis/v9"
 )
 
+// RateLimiter counts requests per key in fixed windows. Each limiter keeps
+// its counters under its own name, so keys of one can never collide with
+// those of another.
 type RateLimiter struct {
 	redis       *redis.Client
+	name        string
 	maxRequests int
 	window      time.Duration
 }
 
-func NewRateLimiter(redisClient *redis.Client, maxRequests int, window time.Duration) *RateLimiter {
+func NewRateLimiter(redisClient *redis.Client, name string, maxRequests int, window time.Duration) *RateLimiter {
 	return &RateLimiter{
 		redis:       redisClient,
+		name:        name,
 		maxRequests: maxRequests,
 		window:      window,
 	}
 }
 
+func (rl *RateLimiter) redisKey(key string) string {
+	return fmt.Sprintf("rate_limit:%s:%s", rl.name, key)
+}
+
 func (rl *RateLimiter) Middleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		ip := getClientIP(r)
-		key := fmt.Sprintf("rate_limit:%s", ip)
+		ip := ClientIP(r)
 
-		ctx := context.Background()
-		count, err := rl.redis.Incr(ctx, key).Result()
+		count, err := rl.Hit(context.Background(), ip)
 		if err != nil {
 			http.Error(w, "Internal server error", http.StatusInternalServerError)
 			return
 		}
 
-		if count == 1 {
-			rl.redis.Expire(ctx, key, rl.window)
-		}
-
 		if count > int64(rl.maxRequests) {
 			w.Header().Set("X-RateLimit-Limit", fmt.Sprintf("%d", rl.maxRequests))
 			w.Header().Set("X-RateLimit-Remaining", "0")
@@ -54,15 +56,38 @@ func (rl *RateLimiter) Middleware(next http.Handler) http.Handler {
 	})
 }
 
-func getClientIP(r *http.Request) string {
-	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
-		if idx := strings.Index(xff, ","); idx != -1 {
-			return strings.TrimSpace(xff[:idx])
-		}
-		return strings.TrimSpace(xff)
+// Limit returns how many requests are allowed per window.
+func (rl *RateLimiter) Limit() int {
+	return rl.maxRequests
+}
+
+// Hit counts one request against key and returns the count in the current
+// window.
+func (rl *RateLimiter) Hit(ctx context.Context, key string) (int64, error) {
+	redisKey := rl.redisKey(key)
+
+	count, err := rl.redis.Incr(ctx, redisKey).Result()
+	if err != nil {
+		return 0, err
 	}
-	if xri := r.Header.Get("X-Real-IP"); xri != "" {
-		return xri
+
+	if count == 1 {
+		rl.redis.Expire(ctx, redisKey, rl.window)
 	}
-	return r.RemoteAddr
+
+	return count, nil
+}
+
+// Exceeded reports whether key has used up its requests for the current
+// window without counting a new one.
+func (rl *RateLimiter) Exceeded(ctx context.Context, key string) (bool, error) {
+	count, err := rl.redis.Get(ctx, rl.redisKey(key)).Int64()
+	if err == redis.Nil {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return count >= int64(rl.maxRequests), nil
 }
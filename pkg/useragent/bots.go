@@ -0,0 +1,63 @@
+package useragent
+
+import "strings"
+
+// botMarkers are lowercase substrings of the User-Agent headers sent by
+// crawlers, link preview fetchers, monitoring services and HTTP libraries.
+// Add new entries under the matching group when an unfurler shows up in the
+// click logs; a marker matches anywhere in the header, so keep them specific
+// enough not to hit real browsers.
+var botMarkers = []string{
+	// Generic crawler words; names ending in "bot" are matched by hasBotName.
+	// "+http" starts the contact URL well-behaved crawlers include.
+	"crawler", "spider", "slurp", "crawling", "+http",
+
+	// Chat and social link unfurlers
+	"slackbot", "slack-imgproxy", "twitterbot", "facebookexternalhit",
+	"facebookcatalog", "linkedinbot", "discordbot", "telegrambot",
+	"whatsapp", "skypeuripreview", "vkshare", "pinterest", "redditbot",
+	"embedly", "quora link preview", "bitlybot", "iframely", "mastodon",
+	"google-pagerenderer", "microsoftpreview", "bingpreview",
+
+	// Headless browsers and monitoring
+	"headlesschrome", "phantomjs", "lighthouse", "pingdom", "uptimerobot",
+	"statuscake", "datadog",
+
+	// HTTP libraries and command line tools
+	"curl/", "wget/", "httpie/", "python-requests", "python-urllib",
+	"aiohttp", "go-http-client", "okhttp", "java/", "apache-httpclient",
+	"libwww-perl", "axios/", "node-fetch", "undici", "ruby", "postmanruntime",
+}
+
+// botNameEnds are the characters that follow a crawler's product name, as in
+// "Googlebot/2.1" or "(compatible; SemrushBot)". Phone models such as
+// "CUBOT_X19" or "Cubot Note 7" are followed by others, so they are not bots.
+const botNameEnds = "/;)"
+
+// IsBot reports whether the User-Agent belongs to an automated client.
+func IsBot(ua string) bool {
+	lower := strings.ToLower(ua)
+	for _, marker := range botMarkers {
+		if strings.Contains(lower, marker) {
+			return true
+		}
+	}
+	return hasBotName(lower)
+}
+
+// hasBotName reports whether a product name ending in "bot" appears in the
+// lowercase User-Agent.
+func hasBotName(lower string) bool {
+	for i := 0; ; {
+		j := strings.Index(lower[i:], "bot")
+		if j < 0 {
+			return false
+		}
+
+		end := i + j + len("bot")
+		if end == len(lower) || strings.IndexByte(botNameEnds, lower[end]) >= 0 {
+			return true
+		}
+		i = end
+	}
+}
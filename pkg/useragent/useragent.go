@@ -0,0 +1,100 @@
+package useragent
+
+import "strings"
+
+const (
+	DeviceDesktop = "desktop"
+	DeviceMobile  = "mobile"
+	DeviceTablet  = "tablet"
+	DeviceBot     = "bot"
+	Unknown       = "unknown"
+)
+
+// Info is what a User-Agent header says about the client. Fields the header
+// does not reveal are "unknown".
+type Info struct {
+	Device  string
+	OS      string
+	Browser string
+	IsBot   bool
+}
+
+// osMarkers are checked in order, so iOS comes before macOS (iPad user agents
+// contain "like Mac OS X") and Android before Linux.
+var osMarkers = []struct {
+	marker string
+	name   string
+}{
+	{"Windows", "Windows"},
+	{"iPhone", "iOS"},
+	{"iPad", "iOS"},
+	{"iPod", "iOS"},
+	{"Android", "Android"},
+	{"CrOS", "ChromeOS"},
+	{"Mac OS X", "macOS"},
+	{"Macintosh", "macOS"},
+	{"Linux", "Linux"},
+}
+
+// browserMarkers are checked in order, since most browsers also claim to be
+// Chrome, Safari or Mozilla.
+var browserMarkers = []struct {
+	marker string
+	name   string
+}{
+	{"Edg", "Edge"},
+	{"OPR/", "Opera"},
+	{"Opera", "Opera"},
+	{"SamsungBrowser", "Samsung Internet"},
+	{"YaBrowser", "Yandex"},
+	{"Firefox/", "Firefox"},
+	{"FxiOS", "Firefox"},
+	{"CriOS", "Chrome"},
+	{"Chrome/", "Chrome"},
+	{"Safari/", "Safari"},
+	{"MSIE", "Internet Explorer"},
+	{"Trident/", "Internet Explorer"},
+}
+
+// Parse classifies a User-Agent header.
+func Parse(ua string) Info {
+	info := Info{
+		Device:  Unknown,
+		OS:      Unknown,
+		Browser: Unknown,
+	}
+
+	if ua == "" {
+		return info
+	}
+
+	info.IsBot = IsBot(ua)
+
+	for _, m := range osMarkers {
+		if strings.Contains(ua, m.marker) {
+			info.OS = m.name
+			break
+		}
+	}
+
+	for _, m := range browserMarkers {
+		if strings.Contains(ua, m.marker) {
+			info.Browser = m.name
+			break
+		}
+	}
+
+	switch {
+	case info.IsBot:
+		info.Device = DeviceBot
+	case strings.Contains(ua, "iPad") || strings.Contains(ua, "Tablet") ||
+		(strings.Contains(ua, "Android") && !strings.Contains(ua, "Mobile")):
+		info.Device = DeviceTablet
+	case strings.Contains(ua, "Mobi") || strings.Contains(ua, "iPhone") || strings.Contains(ua, "iPod"):
+		info.Device = DeviceMobile
+	case info.OS != Unknown:
+		info.Device = DeviceDesktop
+	}
+
+	return info
+}
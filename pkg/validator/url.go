@@ -89,6 +89,31 @@ func isPrivateIP(ip net.IP) error {
 	return nil
 }
 
+func ValidateRedirectStatus(code int32) error {
+	switch code {
+	case 301, 302, 307, 308:
+		return nil
+	}
+	return fmt.Errorf("redirect status must be 301, 302, 307 or 308")
+}
+
+// ValidateCampaignTag checks a campaign, source or medium value. They end up
+// in Redis keys and redirect query strings, so they are kept short and free
+// of control characters.
+func ValidateCampaignTag(value string) error {
+	if len(value) > 100 {
+		return fmt.Errorf("must be at most 100 characters")
+	}
+
+	for _, r := range value {
+		if r < 32 || r == 127 {
+			return fmt.Errorf("must not contain control characters")
+		}
+	}
+
+	return nil
+}
+
 func ValidateShortCode(code string) error {
 	if code == "" {
 		return fmt.Errorf("short code cannot be empty")
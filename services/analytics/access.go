@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"log"
+
+	pb "github.com/gorgio/network/api/proto"
+	"github.com/gorgio/network/pkg/middleware"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// authorizeStats checks that the caller may read the analytics of shortCode:
+// admins always may, everyone else needs to own the link or hold its stats
+// token, which the URL service checks.
+func (s *AnalyticsServiceServer) authorizeStats(ctx context.Context, shortCode, statsToken string) error {
+	caller := middleware.ClaimsFromIncoming(ctx)
+	if caller != nil && caller.Admin {
+		return nil
+	}
+
+	var userID string
+	if caller != nil {
+		userID = caller.UserID
+	}
+	if userID == "" && statsToken == "" {
+		return status.Error(codes.Unauthenticated, "sign in or use a stats token to view these stats")
+	}
+
+	_, err := s.urls.AuthorizeStats(ctx, &pb.AuthorizeStatsRequest{
+		ShortCode:  shortCode,
+		UserId:     userID,
+		StatsToken: statsToken,
+	})
+	if err != nil {
+		switch status.Code(err) {
+		case codes.InvalidArgument, codes.NotFound, codes.PermissionDenied, codes.Unauthenticated:
+			return err
+		}
+		log.Printf("Failed to authorize stats of %s: %v", shortCode, err)
+		return status.Error(codes.Unavailable, "failed to check access to stats")
+	}
+
+	return nil
+}
+
+// requireAdmin lets only admins through, for analytics across every link.
+func requireAdmin(ctx context.Context) error {
+	caller := middleware.ClaimsFromIncoming(ctx)
+	if caller == nil {
+		return status.Error(codes.Unauthenticated, "sign in to view these stats")
+	}
+	if !caller.Admin {
+		return status.Error(codes.PermissionDenied, "admin access required")
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	pb "github.com/gorgio/network/api/proto"
+	"github.com/gorgio/network/pkg/useragent"
+	"github.com/redis/go-redis/v9"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Dimensions a link's clicks can be broken down by, all derived from the
+// User-Agent header.
+const (
+	dimensionDevice  = "device"
+	dimensionOS      = "os"
+	dimensionBrowser = "browser"
+	dimensionBot     = "bot"
+)
+
+func breakdownKey(shortCode, dimension string) string {
+	return fmt.Sprintf("clicks:ua:%s:%s", dimension, shortCode)
+}
+
+// recordBreakdown queues one click into the link's sorted set for every
+// dimension.
+func recordBreakdown(ctx context.Context, pipe redis.Pipeliner, click *ClickData) {
+	info := useragent.Parse(click.UserAgent)
+
+	kind := "human"
+	if click.IsBot {
+		kind = "bot"
+	}
+
+	values := map[string]string{
+		dimensionDevice:  info.Device,
+		dimensionOS:      info.OS,
+		dimensionBrowser: info.Browser,
+		dimensionBot:     kind,
+	}
+
+	for dimension, value := range values {
+		key := breakdownKey(click.ShortCode, dimension)
+		pipe.ZIncrBy(ctx, key, 1, value)
+		pipe.Expire(ctx, key, 30*24*time.Hour)
+	}
+}
+
+func (s *AnalyticsServiceServer) GetBreakdown(ctx context.Context, req *pb.GetBreakdownRequest) (*pb.GetBreakdownResponse, error) {
+	log.Printf("GetBreakdown: short_code=%s, dimension=%s", req.ShortCode, req.Dimension)
+
+	if err := s.authorizeStats(ctx, req.ShortCode, req.StatsToken); err != nil {
+		return nil, err
+	}
+
+	switch req.Dimension {
+	case dimensionDevice, dimensionOS, dimensionBrowser, dimensionBot:
+	default:
+		return nil, status.Error(codes.InvalidArgument, "dimension must be device, os, browser or bot")
+	}
+
+	limit := req.Limit
+	if limit <= 0 || limit > 100 {
+		limit = 100
+	}
+
+	results, err := s.redis.ZRevRangeWithScores(ctx, breakdownKey(req.ShortCode, req.Dimension), 0, int64(limit-1)).Result()
+	if err != nil {
+		log.Printf("Failed to get breakdown: %v", err)
+		return &pb.GetBreakdownResponse{Items: []*pb.BreakdownItem{}}, nil
+	}
+
+	items := make([]*pb.BreakdownItem, 0, len(results))
+	for _, result := range results {
+		items = append(items, &pb.BreakdownItem{
+			Value: result.Member.(string),
+			Count: int64(result.Score),
+		})
+	}
+
+	return &pb.GetBreakdownResponse{Items: items}, nil
+}
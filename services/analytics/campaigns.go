@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	pb "github.com/gorgio/network/api/proto"
+	"github.com/gorgio/network/pkg/middleware"
+	"github.com/redis/go-redis/v9"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Parts of a campaign that are counted, each under its own key.
+const (
+	campaignTotal   = "total"
+	campaignURLs    = "urls"
+	campaignSources = "sources"
+	campaignMediums = "mediums"
+
+	defaultCampaignLimit = 10
+	unknownCampaignTag   = "unknown"
+)
+
+// campaignKey is scoped to the owner so that users picking the same campaign
+// name never see each other's clicks. The campaign name goes last because it
+// may contain colons.
+func campaignKey(part, ownerID, campaign string) string {
+	return fmt.Sprintf("clicks:campaign:%s:%s:%s", part, ownerID, campaign)
+}
+
+// recordCampaign queues one human click into its campaign's total and into
+// the per-link, per-source and per-medium sorted sets. Like link totals they
+// never expire. Links outside a campaign record nothing.
+func recordCampaign(ctx context.Context, pipe redis.Pipeliner, click *ClickData) {
+	if click.Campaign == "" || click.OwnerID == "" {
+		return
+	}
+
+	source, medium := click.Source, click.Medium
+	if source == "" {
+		source = unknownCampaignTag
+	}
+	if medium == "" {
+		medium = unknownCampaignTag
+	}
+
+	pipe.Incr(ctx, campaignKey(campaignTotal, click.OwnerID, click.Campaign))
+	pipe.ZIncrBy(ctx, campaignKey(campaignURLs, click.OwnerID, click.Campaign), 1, click.ShortCode)
+	pipe.ZIncrBy(ctx, campaignKey(campaignSources, click.OwnerID, click.Campaign), 1, source)
+	pipe.ZIncrBy(ctx, campaignKey(campaignMediums, click.OwnerID, click.Campaign), 1, medium)
+}
+
+func (s *AnalyticsServiceServer) GetCampaignStats(ctx context.Context, req *pb.GetCampaignStatsRequest) (*pb.GetCampaignStatsResponse, error) {
+	log.Printf("GetCampaignStats: user_id=%s, campaign=%s", req.UserId, req.Campaign)
+
+	if req.UserId == "" {
+		return nil, status.Error(codes.InvalidArgument, "user ID is required")
+	}
+	if req.Campaign == "" {
+		return nil, status.Error(codes.InvalidArgument, "campaign is required")
+	}
+
+	caller := middleware.ClaimsFromIncoming(ctx)
+	if caller == nil {
+		return nil, status.Error(codes.Unauthenticated, "sign in to view campaign stats")
+	}
+	if caller.UserID != req.UserId && !caller.Admin {
+		return nil, status.Error(codes.PermissionDenied, "campaign belongs to another user")
+	}
+
+	limit := req.Limit
+	if limit <= 0 {
+		limit = defaultCampaignLimit
+	}
+	if limit > 100 {
+		limit = 100
+	}
+
+	pipe := s.redis.Pipeline()
+	totalCmd := pipe.Get(ctx, campaignKey(campaignTotal, req.UserId, req.Campaign))
+	urlsCmd := pipe.ZRevRangeWithScores(ctx, campaignKey(campaignURLs, req.UserId, req.Campaign), 0, int64(limit-1))
+	sourcesCmd := pipe.ZRevRangeWithScores(ctx, campaignKey(campaignSources, req.UserId, req.Campaign), 0, int64(limit-1))
+	mediumsCmd := pipe.ZRevRangeWithScores(ctx, campaignKey(campaignMediums, req.UserId, req.Campaign), 0, int64(limit-1))
+
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		log.Printf("Failed to get campaign stats: %v", err)
+		return nil, status.Error(codes.Internal, "failed to get campaign stats")
+	}
+
+	total, _ := totalCmd.Int64()
+
+	urls := make([]*pb.TopURLItem, 0, len(urlsCmd.Val()))
+	for _, result := range urlsCmd.Val() {
+		urls = append(urls, &pb.TopURLItem{
+			ShortCode: result.Member.(string),
+			Clicks:    int64(result.Score),
+		})
+	}
+
+	return &pb.GetCampaignStatsResponse{
+		TotalClicks: total,
+		Urls:        urls,
+		Sources:     breakdownItems(sourcesCmd.Val()),
+		Mediums:     breakdownItems(mediumsCmd.Val()),
+	}, nil
+}
+
+func breakdownItems(results []redis.Z) []*pb.BreakdownItem {
+	items := make([]*pb.BreakdownItem, 0, len(results))
+	for _, result := range results {
+		items = append(items, &pb.BreakdownItem{
+			Value: result.Member.(string),
+			Count: int64(result.Score),
+		})
+	}
+	return items
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const eventReadBatch = 1000
+
+// ClickEventLog is the append-only record of every click. Events go into one
+// Redis Stream per UTC day, and each day's stream expires once it is older
+// than the retention period. Visitors are only identified by their hashed ID.
+type ClickEventLog struct {
+	redis     *redis.Client
+	retention time.Duration
+}
+
+func NewClickEventLog(redisClient *redis.Client, retention time.Duration) *ClickEventLog {
+	return &ClickEventLog{
+		redis:     redisClient,
+		retention: retention,
+	}
+}
+
+func eventStreamKey(day time.Time) string {
+	return fmt.Sprintf("clicks:events:%s", day.UTC().Format("2006-01-02"))
+}
+
+func (l *ClickEventLog) Append(ctx context.Context, click *ClickData) error {
+	ts := time.Unix(click.Timestamp, 0)
+	key := eventStreamKey(ts)
+
+	dayStart := ts.UTC().Truncate(24 * time.Hour)
+	expireAt := dayStart.Add(24*time.Hour + l.retention)
+
+	pipe := l.redis.Pipeline()
+	pipe.XAdd(ctx, &redis.XAddArgs{
+		Stream: key,
+		Values: map[string]interface{}{
+			"code": click.ShortCode,
+			"ua":   click.UserAgent,
+			"ref":  click.Referer,
+			"vid":  click.VisitorID,
+			"bot":  strconv.FormatBool(click.IsBot),
+			"own":  click.OwnerID,
+			"cmp":  click.Campaign,
+			"src":  click.Source,
+			"med":  click.Medium,
+			"cc":   click.Country,
+			"city": click.City,
+			"ts":   click.Timestamp,
+		},
+	})
+	pipe.ExpireAt(ctx, key, expireAt)
+
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// Range calls fn for every event with a timestamp in [from, to), oldest
+// first. Events older than the retention period are gone.
+func (l *ClickEventLog) Range(ctx context.Context, from, to time.Time, fn func(*ClickData) error) error {
+	for day := from.UTC().Truncate(24 * time.Hour); day.Before(to); day = day.Add(24 * time.Hour) {
+		if err := l.rangeDay(ctx, eventStreamKey(day), from, to, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (l *ClickEventLog) rangeDay(ctx context.Context, key string, from, to time.Time, fn func(*ClickData) error) error {
+	start := "-"
+	for {
+		messages, err := l.redis.XRangeN(ctx, key, start, "+", eventReadBatch).Result()
+		if err != nil {
+			return err
+		}
+
+		for _, msg := range messages {
+			click := clickFromEvent(msg.Values)
+			ts := time.Unix(click.Timestamp, 0)
+			if ts.Before(from) || !ts.Before(to) {
+				continue
+			}
+			if err := fn(click); err != nil {
+				return err
+			}
+		}
+
+		if len(messages) < eventReadBatch {
+			return nil
+		}
+		// "(" makes the next page start after the last ID we saw.
+		start = "(" + messages[len(messages)-1].ID
+	}
+}
+
+func clickFromEvent(values map[string]interface{}) *ClickData {
+	field := func(name string) string {
+		if value, ok := values[name].(string); ok {
+			return value
+		}
+		return ""
+	}
+
+	ts, _ := strconv.ParseInt(field("ts"), 10, 64)
+	isBot, _ := strconv.ParseBool(field("bot"))
+
+	return &ClickData{
+		ShortCode: field("code"),
+		UserAgent: field("ua"),
+		Referer:   field("ref"),
+		VisitorID: field("vid"),
+		IsBot:     isBot,
+		OwnerID:   field("own"),
+		Campaign:  field("cmp"),
+		Source:    field("src"),
+		Medium:    field("med"),
+		Country:   field("cc"),
+		City:      field("city"),
+		Timestamp: ts,
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	pb "github.com/gorgio/network/api/proto"
+	"github.com/redis/go-redis/v9"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	geoLevelCountry = "country"
+	geoLevelCity    = "city"
+
+	unknownLocation = "unknown"
+)
+
+func geoKey(shortCode, level string) string {
+	return fmt.Sprintf("clicks:geo:%s:%s", level, shortCode)
+}
+
+// locate fills in the click's country and city from its IP address.
+// Countries are ISO codes and cities "Name, CC"; addresses the database does
+// not know are unknown. Without a database nothing is filled in.
+func (s *AnalyticsServiceServer) locate(click *ClickData) {
+	if s.geo == nil {
+		return
+	}
+
+	click.Country, click.City = unknownLocation, unknownLocation
+
+	if ip := net.ParseIP(click.IPAddress); ip != nil {
+		location, err := s.geo.Locate(ip)
+		if err != nil {
+			log.Printf("Failed to locate %s: %v", click.IPAddress, err)
+		} else if location.CountryCode != "" {
+			click.Country = location.CountryCode
+			if location.City != "" {
+				click.City = fmt.Sprintf("%s, %s", location.City, location.CountryCode)
+			}
+		}
+	}
+}
+
+// recordGeo queues one click into the link's country and city sorted sets.
+// Without a database nothing is recorded.
+func (s *AnalyticsServiceServer) recordGeo(ctx context.Context, pipe redis.Pipeliner, click *ClickData) {
+	if s.geo == nil {
+		return
+	}
+
+	// Events logged before locations were stored still carry the address.
+	if click.Country == "" {
+		s.locate(click)
+	}
+
+	for level, value := range map[string]string{geoLevelCountry: click.Country, geoLevelCity: click.City} {
+		key := geoKey(click.ShortCode, level)
+		pipe.ZIncrBy(ctx, key, 1, value)
+		pipe.Expire(ctx, key, 30*24*time.Hour)
+	}
+}
+
+func (s *AnalyticsServiceServer) GetGeoBreakdown(ctx context.Context, req *pb.GetGeoBreakdownRequest) (*pb.GetGeoBreakdownResponse, error) {
+	log.Printf("GetGeoBreakdown: short_code=%s, level=%s", req.ShortCode, req.Level)
+
+	if err := s.authorizeStats(ctx, req.ShortCode, req.StatsToken); err != nil {
+		return nil, err
+	}
+
+	level := req.Level
+	if level == "" {
+		level = geoLevelCountry
+	}
+	if level != geoLevelCountry && level != geoLevelCity {
+		return nil, status.Error(codes.InvalidArgument, "level must be country or city")
+	}
+
+	limit := req.Limit
+	if limit <= 0 || limit > 100 {
+		limit = 100
+	}
+
+	results, err := s.redis.ZRevRangeWithScores(ctx, geoKey(req.ShortCode, level), 0, int64(limit-1)).Result()
+	if err != nil {
+		log.Printf("Failed to get geo breakdown: %v", err)
+		return &pb.GetGeoBreakdownResponse{Items: []*pb.BreakdownItem{}}, nil
+	}
+
+	items := make([]*pb.BreakdownItem, 0, len(results))
+	for _, result := range results {
+		items = append(items, &pb.BreakdownItem{
+			Value: result.Member.(string),
+			Count: int64(result.Score),
+		})
+	}
+
+	return &pb.GetGeoBreakdownResponse{Items: items}, nil
+}
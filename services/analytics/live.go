@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	pb "github.com/gorgio/network/api/proto"
+	"github.com/gorgio/network/pkg/useragent"
+	"github.com/redis/go-redis/v9"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// Recorded clicks are announced on a Redis pub/sub channel per link, so every
+// analytics replica can stream the clicks another one recorded. Nothing is
+// kept: a viewer only sees clicks made while it is subscribed.
+
+func liveChannel(shortCode string) string {
+	return fmt.Sprintf("clicks:live:%s", shortCode)
+}
+
+// publishClick queues the announcement of one click. Replays from the event
+// log are not announced.
+func publishClick(ctx context.Context, pipe redis.Pipeliner, click *ClickData) {
+	event := &pb.ClickEvent{
+		ShortCode: click.ShortCode,
+		Timestamp: click.Timestamp,
+		IsBot:     click.IsBot,
+		Device:    useragent.Parse(click.UserAgent).Device,
+	}
+	if domain, _, ok := normalizeReferer(click.Referer); ok {
+		event.Referer = domain
+	}
+
+	payload, err := proto.Marshal(event)
+	if err != nil {
+		log.Printf("Failed to encode click event: %v", err)
+		return
+	}
+
+	pipe.Publish(ctx, liveChannel(click.ShortCode), payload)
+}
+
+// StreamClicks sends the link's clicks as they are recorded until the caller
+// goes away. Live clicks are only for the link's owner, so stats tokens do
+// not open them.
+func (s *AnalyticsServiceServer) StreamClicks(req *pb.StreamClicksRequest, stream pb.AnalyticsService_StreamClicksServer) error {
+	log.Printf("StreamClicks: short_code=%s", req.ShortCode)
+
+	if req.ShortCode == "" {
+		return status.Error(codes.InvalidArgument, "short code is required")
+	}
+
+	ctx := stream.Context()
+	if err := s.authorizeStats(ctx, req.ShortCode, ""); err != nil {
+		return err
+	}
+	sub := s.redis.Subscribe(ctx, liveChannel(req.ShortCode))
+	defer sub.Close()
+
+	// Wait for the subscription to be confirmed so that no click recorded
+	// after this point is missed.
+	if _, err := sub.Receive(ctx); err != nil {
+		log.Printf("Failed to subscribe to clicks of %s: %v", req.ShortCode, err)
+		return status.Error(codes.Unavailable, "failed to subscribe to clicks")
+	}
+
+	messages := sub.Channel()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case msg, ok := <-messages:
+			if !ok {
+				return status.Error(codes.Unavailable, "click subscription closed")
+			}
+
+			var event pb.ClickEvent
+			if err := proto.Unmarshal([]byte(msg.Payload), &event); err != nil {
+				log.Printf("Failed to decode click event: %v", err)
+				continue
+			}
+
+			if err := stream.Send(&event); err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -2,22 +2,37 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
 	"log"
 	"net"
-	"sync"
+	"os"
+	"strconv"
 	"time"
+	_ "time/tzdata" // ANALYTICS_TIMEZONE must load without system zoneinfo
 
 	pb "github.com/gorgio/network/api/proto"
+	"github.com/gorgio/network/pkg/database"
+	"github.com/gorgio/network/pkg/geoip"
+	"github.com/gorgio/network/pkg/useragent"
 	"github.com/redis/go-redis/v9"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
 )
 
 type AnalyticsServiceServer struct {
 	pb.UnimplementedAnalyticsServiceServer
 	redis   *redis.Client
-	clicks  map[string][]*ClickData
-	mu      sync.RWMutex
+	events  *ClickEventLog
+	rollups *database.ClickRollupDB
+	urls    pb.URLServiceClient // checks who may read a link's stats
+	geo     *geoip.Reader       // nil when no database is configured
+	// visitorSecret keys the hash that visitor IDs are stored as.
+	visitorSecret []byte
+	// loc is the timezone that days, weeks and months are counted in.
+	loc *time.Location
 }
 
 type ClickData struct {
@@ -25,85 +40,188 @@ type ClickData struct {
 	IPAddress string
 	UserAgent string
 	Referer   string
+	VisitorID string
+	IsBot     bool
+	OwnerID   string
+	Campaign  string
+	Source    string
+	Medium    string
 	Timestamp int64
+	// Country and City are where IPAddress was located, filled in before the
+	// click is logged so that the address itself need not be kept.
+	Country string
+	City    string
 }
 
-func NewAnalyticsServiceServer(redisClient *redis.Client) *AnalyticsServiceServer {
+func NewAnalyticsServiceServer(redisClient *redis.Client, events *ClickEventLog, rollups *database.ClickRollupDB, urls pb.URLServiceClient, geo *geoip.Reader, loc *time.Location, visitorSecret []byte) *AnalyticsServiceServer {
 	return &AnalyticsServiceServer{
-		redis:  redisClient,
-		clicks: make(map[string][]*ClickData),
+		redis:         redisClient,
+		events:        events,
+		rollups:       rollups,
+		urls:          urls,
+		geo:           geo,
+		loc:           loc,
+		visitorSecret: visitorSecret,
 	}
 }
 
 func (s *AnalyticsServiceServer) RecordClick(ctx context.Context, req *pb.RecordClickRequest) (*pb.RecordClickResponse, error) {
 	log.Printf("RecordClick: short_code=%s, ip=%s", req.ShortCode, req.IpAddress)
 
-	shortCode := req.ShortCode
-	ipAddress := req.IpAddress[:min(len(req.IpAddress), 45)]
-	userAgent := req.UserAgent[:min(len(req.UserAgent), 500)]
-	referer := req.Referer[:min(len(req.Referer), 500)]
-	now := time.Now()
-
 	clickData := &ClickData{
-		ShortCode: shortCode,
-		IPAddress: ipAddress,
-		UserAgent: userAgent,
-		Referer:   referer,
-		Timestamp: now.Unix(),
+		ShortCode: req.ShortCode,
+		IPAddress: req.IpAddress[:min(len(req.IpAddress), 45)],
+		UserAgent: req.UserAgent[:min(len(req.UserAgent), 500)],
+		Referer:   req.Referer[:min(len(req.Referer), 500)],
+		VisitorID: req.VisitorId[:min(len(req.VisitorId), 64)],
+		IsBot:     req.IsBot || useragent.IsBot(req.UserAgent),
+		OwnerID:   req.OwnerId[:min(len(req.OwnerId), 50)],
+		Campaign:  req.Campaign[:min(len(req.Campaign), 100)],
+		Source:    req.Source[:min(len(req.Source), 100)],
+		Medium:    req.Medium[:min(len(req.Medium), 100)],
+		Timestamp: time.Now().Unix(),
+	}
+	if clickData.VisitorID == "" {
+		clickData.VisitorID = clickData.IPAddress
+	}
+	clickData.VisitorID = s.hashVisitorID(clickData.VisitorID)
+	s.locate(clickData)
+
+	if err := s.events.Append(ctx, clickData); err != nil {
+		log.Printf("Failed to append click event: %v", err)
+	}
+
+	pipe := s.redis.Pipeline()
+	s.recordAggregates(ctx, pipe, clickData)
+	publishClick(ctx, pipe, clickData)
+
+	_, err := pipe.Exec(ctx)
+	if err != nil {
+		log.Printf("Failed to record click in Redis: %v", err)
 	}
 
-	s.mu.Lock()
-	s.clicks[shortCode] = append(s.clicks[shortCode], clickData)
-	s.mu.Unlock()
+	log.Printf("Click recorded for %s", req.ShortCode)
+
+	return &pb.RecordClickResponse{
+		Success: true,
+	}, nil
+}
+
+// recordAggregates queues the counter updates for one click. RecordClick and
+// rebuilds from the event log share it so both produce the same keys. Bot hits
+// only count towards bot_clicks and the client breakdowns.
+func (s *AnalyticsServiceServer) recordAggregates(ctx context.Context, pipe redis.Pipeliner, click *ClickData) {
+	shortCode := click.ShortCode
+
+	recordBreakdown(ctx, pipe, click)
+
+	if click.IsBot {
+		pipe.Incr(ctx, fmt.Sprintf("clicks:bot:%s", shortCode))
+		return
+	}
+	now := time.Unix(click.Timestamp, 0).In(s.loc)
 
 	totalKey := fmt.Sprintf("clicks:total:%s", shortCode)
-	uniqueKey := fmt.Sprintf("clicks:unique:%s", shortCode)
+	visitorsKey := fmt.Sprintf("clicks:visitors:%s", shortCode)
+	visitorsDayKey := dayVisitorsKey(shortCode, now)
 	dateKey := fmt.Sprintf("clicks:daily:%s:%s", shortCode, now.Format("2006-01-02"))
 	hourKey := fmt.Sprintf("clicks:hourly:%s:%s", shortCode, now.Format("2006-01-02-15"))
-	refererKey := fmt.Sprintf("clicks:referers:%s", shortCode)
-	globalKey := "clicks:global:sorted"
-	globalWeekKey := fmt.Sprintf("clicks:global:week:%s", now.Format("2006-W01"))
-	globalMonthKey := fmt.Sprintf("clicks:global:month:%s", now.Format("2006-01"))
+	dayKey := globalDayKey(now)
+	weekKey := globalWeekKey(now)
+	monthKey := globalMonthKey(now)
 
-	pipe := s.redis.Pipeline()
 	pipe.Incr(ctx, totalKey)
-	pipe.SAdd(ctx, uniqueKey, req.IpAddress)
+	// Totals never expire; older releases gave them a 30-day TTL.
+	pipe.Persist(ctx, totalKey)
+	pipe.PFAdd(ctx, visitorsKey, click.VisitorID)
+	pipe.PFAdd(ctx, visitorsDayKey, click.VisitorID)
 	pipe.Incr(ctx, dateKey)
 	pipe.Incr(ctx, hourKey)
 
-	if referer != "" {
-		pipe.ZIncrBy(ctx, refererKey, 1, referer)
-		pipe.Expire(ctx, refererKey, 30*24*time.Hour)
+	if domain, pageURL, ok := normalizeReferer(click.Referer); ok {
+		domainKey := refererKey(shortCode, refererGroupDomain)
+		urlKey := refererKey(shortCode, refererGroupURL)
+
+		pipe.ZIncrBy(ctx, domainKey, 1, domain)
+		pipe.ZIncrBy(ctx, urlKey, 1, pageURL)
+		pipe.Expire(ctx, domainKey, 30*24*time.Hour)
+		pipe.Expire(ctx, urlKey, 30*24*time.Hour)
 	}
 
-	pipe.ZIncrBy(ctx, globalKey, 1, shortCode)
-	pipe.ZIncrBy(ctx, globalWeekKey, 1, shortCode)
-	pipe.ZIncrBy(ctx, globalMonthKey, 1, shortCode)
+	s.recordGeo(ctx, pipe, click)
+	recordCampaign(ctx, pipe, click)
+
+	pipe.ZIncrBy(ctx, globalAllKey, 1, shortCode)
+	pipe.ZIncrBy(ctx, dayKey, 1, shortCode)
+	pipe.ZIncrBy(ctx, weekKey, 1, shortCode)
+	pipe.ZIncrBy(ctx, monthKey, 1, shortCode)
 
-	pipe.Expire(ctx, totalKey, 30*24*time.Hour)
-	pipe.Expire(ctx, uniqueKey, 30*24*time.Hour)
+	pipe.Expire(ctx, visitorsDayKey, 30*24*time.Hour)
 	pipe.Expire(ctx, dateKey, 30*24*time.Hour)
 	pipe.Expire(ctx, hourKey, 30*24*time.Hour)
-	pipe.Expire(ctx, globalWeekKey, 90*24*time.Hour)
-	pipe.Expire(ctx, globalMonthKey, 180*24*time.Hour)
+	pipe.Expire(ctx, dayKey, globalDays*24*time.Hour)
+	pipe.Expire(ctx, weekKey, 90*24*time.Hour)
+	pipe.Expire(ctx, monthKey, 180*24*time.Hour)
+}
 
-	_, err := pipe.Exec(ctx)
+// rebuildAggregates replays logged clicks in [from, to) into the Redis
+// counters. Counters are incremented, not reset, so run it only over a range
+// whose aggregates were lost. Clicks from before a code was purged are
+// skipped.
+func (s *AnalyticsServiceServer) rebuildAggregates(ctx context.Context, from, to time.Time) (int, error) {
+	count := 0
+	pipe := s.redis.Pipeline()
+	purged := make(map[string]int64)
+
+	err := s.events.Range(ctx, from, to, func(click *ClickData) error {
+		cutoff, ok := purged[click.ShortCode]
+		if !ok {
+			var err error
+			if cutoff, err = s.purgedAt(ctx, click.ShortCode); err != nil {
+				return err
+			}
+			purged[click.ShortCode] = cutoff
+		}
+		if click.Timestamp <= cutoff {
+			return nil
+		}
+
+		s.recordAggregates(ctx, pipe, click)
+		count++
+
+		if pipe.Len() >= 1000 {
+			if _, err := pipe.Exec(ctx); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
 	if err != nil {
-		log.Printf("Failed to record click in Redis: %v", err)
+		return count, err
 	}
 
-	log.Printf("Click recorded for %s", req.ShortCode)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return count, err
+	}
 
-	return &pb.RecordClickResponse{
-		Success: true,
-	}, nil
+	return count, nil
 }
 
 func (s *AnalyticsServiceServer) GetClickStats(ctx context.Context, req *pb.GetClickStatsRequest) (*pb.GetClickStatsResponse, error) {
-	log.Printf("GetClickStats: short_code=%s", req.ShortCode)
+	log.Printf("GetClickStats: short_code=%s, from=%s, to=%s, granularity=%s", req.ShortCode, req.From, req.To, req.Granularity)
+
+	if err := s.authorizeStats(ctx, req.ShortCode, req.StatsToken); err != nil {
+		return nil, err
+	}
+
+	now := time.Now().In(s.loc)
+	statsRange, err := parseStatsRange(req, now)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
 
 	totalKey := fmt.Sprintf("clicks:total:%s", req.ShortCode)
-	uniqueKey := fmt.Sprintf("clicks:unique:%s", req.ShortCode)
+	visitorsKey := fmt.Sprintf("clicks:visitors:%s", req.ShortCode)
 
 	totalClicks, err := s.redis.Get(ctx, totalKey).Int64()
 	if err != nil {
@@ -113,7 +231,7 @@ func (s *AnalyticsServiceServer) GetClickStats(ctx context.Context, req *pb.GetC
 		totalClicks = 0
 	}
 
-	uniqueClicks, err := s.redis.SCard(ctx, uniqueKey).Result()
+	uniqueClicks, err := s.redis.PFCount(ctx, visitorsKey).Result()
 	if err != nil {
 		if err.Error() != "redis: nil" {
 			log.Printf("Failed to get unique clicks: %v", err)
@@ -121,27 +239,42 @@ func (s *AnalyticsServiceServer) GetClickStats(ctx context.Context, req *pb.GetC
 		uniqueClicks = 0
 	}
 
-	var dailyClicks []*pb.DailyClick
-	for i := 0; i < 7; i++ {
-		date := time.Now().AddDate(0, 0, -i).Format("2006-01-02")
-		dateKey := fmt.Sprintf("clicks:daily:%s:%s", req.ShortCode, date)
-		count, err := s.redis.Get(ctx, dateKey).Int64()
-		if err != nil {
-			count = 0
-		}
-		dailyClicks = append(dailyClicks, &pb.DailyClick{
-			Date:  date,
-			Count: count,
-		})
+	botClicks, err := s.redis.Get(ctx, fmt.Sprintf("clicks:bot:%s", req.ShortCode)).Int64()
+	if err != nil && err != redis.Nil {
+		log.Printf("Failed to get bot clicks: %v", err)
+	}
+
+	slots := statsRange.slots()
+	counts, err := s.countClicks(ctx, req.ShortCode, statsRange, slots, now)
+	if err != nil {
+		log.Printf("Failed to count clicks: %v", err)
+		return nil, fmt.Errorf("failed to get click stats")
 	}
 
 	stats := &pb.ClickStats{
 		TotalClicks:  totalClicks,
 		UniqueClicks: uniqueClicks,
-		DailyClicks:  dailyClicks,
+		BotClicks:    botClicks,
+		Buckets:      statsRange.clickBuckets(slots, counts),
+		Truncated:    counts.truncated,
 	}
 
-	log.Printf("Stats for %s: total=%d, unique=%d", req.ShortCode, totalClicks, uniqueClicks)
+	stats.RangeUniqueClicks, err = s.countVisitors(ctx, req.ShortCode, statsRange, slots, stats.Buckets, now)
+	if err != nil {
+		log.Printf("Failed to count visitors: %v", err)
+		return nil, fmt.Errorf("failed to get click stats")
+	}
+
+	if statsRange.granularity == granularityDay {
+		for _, bucket := range stats.Buckets {
+			stats.DailyClicks = append(stats.DailyClicks, &pb.DailyClick{
+				Date:  bucket.Period,
+				Count: bucket.Count,
+			})
+		}
+	}
+
+	log.Printf("Stats for %s: total=%d, unique=%d, bots=%d", req.ShortCode, totalClicks, uniqueClicks, botClicks)
 
 	return &pb.GetClickStatsResponse{
 		Stats: stats,
@@ -149,28 +282,30 @@ func (s *AnalyticsServiceServer) GetClickStats(ctx context.Context, req *pb.GetC
 }
 
 func (s *AnalyticsServiceServer) GetTopURLs(ctx context.Context, req *pb.GetTopURLsRequest) (*pb.GetTopURLsResponse, error) {
-	log.Printf("GetTopURLs: period=%s, limit=%d", req.Period, req.Limit)
+	log.Printf("GetTopURLs: period=%s, from=%s, to=%s, days=%d, limit=%d", req.Period, req.From, req.To, req.Days, req.Limit)
 
-	var key string
-	now := time.Now()
-
-	switch req.Period {
-	case "all":
-		key = "clicks:global:sorted"
-	case "week":
-		key = fmt.Sprintf("clicks:global:week:%s", now.Format("2006-W01"))
-	case "month":
-		key = fmt.Sprintf("clicks:global:month:%s", now.Format("2006-01"))
-	default:
-		key = "clicks:global:sorted"
+	if err := requireAdmin(ctx); err != nil {
+		return nil, err
 	}
 
+	now := time.Now().In(s.loc)
+
 	limit := req.Limit
 	if limit <= 0 || limit > 100 {
 		limit = 100
 	}
 
-	results, err := s.redis.ZRevRangeWithScores(ctx, key, 0, int64(limit-1)).Result()
+	var results []redis.Z
+	var err error
+	if req.Period == periodRange {
+		from, to, rangeErr := parseTopRange(req, now)
+		if rangeErr != nil {
+			return nil, status.Error(codes.InvalidArgument, rangeErr.Error())
+		}
+		results, err = s.topInRange(ctx, from, to, int64(limit))
+	} else {
+		results, err = s.redis.ZRevRangeWithScores(ctx, globalKey(req.Period, now), 0, int64(limit-1)).Result()
+	}
 	if err != nil {
 		log.Printf("Failed to get top URLs: %v", err)
 		return &pb.GetTopURLsResponse{Urls: []*pb.TopURLItem{}}, nil
@@ -190,16 +325,26 @@ func (s *AnalyticsServiceServer) GetTopURLs(ctx context.Context, req *pb.GetTopU
 }
 
 func (s *AnalyticsServiceServer) GetTopReferers(ctx context.Context, req *pb.GetTopReferersRequest) (*pb.GetTopReferersResponse, error) {
-	log.Printf("GetTopReferers: short_code=%s, limit=%d", req.ShortCode, req.Limit)
+	log.Printf("GetTopReferers: short_code=%s, group_by=%s, limit=%d", req.ShortCode, req.GroupBy, req.Limit)
+
+	if err := s.authorizeStats(ctx, req.ShortCode, req.StatsToken); err != nil {
+		return nil, err
+	}
 
-	refererKey := fmt.Sprintf("clicks:referers:%s", req.ShortCode)
+	groupBy := req.GroupBy
+	if groupBy == "" {
+		groupBy = refererGroupURL
+	}
+	if groupBy != refererGroupURL && groupBy != refererGroupDomain {
+		return nil, status.Error(codes.InvalidArgument, "group_by must be url or domain")
+	}
 
 	limit := req.Limit
 	if limit <= 0 || limit > 100 {
 		limit = 100
 	}
 
-	results, err := s.redis.ZRevRangeWithScores(ctx, refererKey, 0, int64(limit-1)).Result()
+	results, err := s.redis.ZRevRangeWithScores(ctx, refererKey(req.ShortCode, groupBy), 0, int64(limit-1)).Result()
 	if err != nil {
 		log.Printf("Failed to get top referers: %v", err)
 		return &pb.GetTopReferersResponse{Referers: []*pb.RefererItem{}}, nil
@@ -221,9 +366,13 @@ func (s *AnalyticsServiceServer) GetTopReferers(ctx context.Context, req *pb.Get
 func (s *AnalyticsServiceServer) GetHourlyDistribution(ctx context.Context, req *pb.GetHourlyDistributionRequest) (*pb.GetHourlyDistributionResponse, error) {
 	log.Printf("GetHourlyDistribution: short_code=%s, date=%s", req.ShortCode, req.Date)
 
+	if err := s.authorizeStats(ctx, req.ShortCode, req.StatsToken); err != nil {
+		return nil, err
+	}
+
 	date := req.Date
 	if date == "" {
-		date = time.Now().Format("2006-01-02")
+		date = time.Now().In(s.loc).Format("2006-01-02")
 	}
 
 	var hours []*pb.HourlyClick
@@ -244,7 +393,45 @@ func (s *AnalyticsServiceServer) GetHourlyDistribution(ctx context.Context, req
 	return &pb.GetHourlyDistributionResponse{Hours: hours}, nil
 }
 
+// GetClickCounts returns total clicks for many links using one pipelined
+// round trip to Redis. Only the URL service calls it, for links it has
+// already checked the ownership of.
+func (s *AnalyticsServiceServer) GetClickCounts(ctx context.Context, req *pb.GetClickCountsRequest) (*pb.GetClickCountsResponse, error) {
+	log.Printf("GetClickCounts: codes=%d", len(req.ShortCodes))
+
+	counts := make(map[string]int64, len(req.ShortCodes))
+	if len(req.ShortCodes) == 0 {
+		return &pb.GetClickCountsResponse{Counts: counts}, nil
+	}
+
+	pipe := s.redis.Pipeline()
+	cmds := make([]*redis.StringCmd, len(req.ShortCodes))
+	for i, shortCode := range req.ShortCodes {
+		cmds[i] = pipe.Get(ctx, fmt.Sprintf("clicks:total:%s", shortCode))
+	}
+
+	_, err := pipe.Exec(ctx)
+	if err != nil && err != redis.Nil {
+		log.Printf("Failed to get click counts: %v", err)
+		return nil, fmt.Errorf("failed to get click counts")
+	}
+
+	for i, cmd := range cmds {
+		count, err := cmd.Int64()
+		if err != nil {
+			continue
+		}
+		counts[req.ShortCodes[i]] = count
+	}
+
+	return &pb.GetClickCountsResponse{Counts: counts}, nil
+}
+
 func main() {
+	rebuildFrom := flag.String("rebuild-from", "", "replay logged clicks from this date (YYYY-MM-DD) into the aggregates and exit")
+	rebuildTo := flag.String("rebuild-to", "", "end date (exclusive) for -rebuild-from, defaults to now")
+	flag.Parse()
+
 	redisClient := redis.NewClient(&redis.Options{
 		Addr: "redis:6379",
 	})
@@ -256,16 +443,110 @@ func main() {
 		log.Println("Connected to Redis")
 	}
 
+	retentionDays := positiveIntEnv("CLICK_EVENT_RETENTION_DAYS", 90)
+
+	loc := time.UTC
+	if name := os.Getenv("ANALYTICS_TIMEZONE"); name != "" {
+		parsed, err := time.LoadLocation(name)
+		if err != nil {
+			log.Fatalf("Invalid ANALYTICS_TIMEZONE: %v", err)
+		}
+		loc = parsed
+	}
+	log.Printf("Counting days in %s", loc)
+
+	databaseURL := os.Getenv("DATABASE_URL")
+	if databaseURL == "" {
+		log.Fatal("DATABASE_URL environment variable is not set")
+	}
+
+	rollups, err := database.NewClickRollupDB(databaseURL, loc)
+	if err != nil {
+		log.Fatalf("Failed to connect to database: %v", err)
+	}
+	defer rollups.Close()
+	log.Println("Connected to PostgreSQL")
+
+	var geo *geoip.Reader
+	if geoPath := os.Getenv("GEOIP_DB_PATH"); geoPath != "" {
+		geo, err = geoip.Open(geoPath)
+		if err != nil {
+			log.Printf("Warning: GeoIP database unavailable, geolocation disabled: %v", err)
+			geo = nil
+		} else {
+			log.Printf("Loaded GeoIP database %s", geoPath)
+		}
+	}
+
+	// The URL service also calls this one, so the connection is made lazily
+	// on first use rather than at startup.
+	urlConn, err := grpc.Dial("urlservice:8081", grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		log.Fatalf("Failed to connect to URL service: %v", err)
+	}
+	defer urlConn.Close()
+
+	events := NewClickEventLog(redisClient, time.Duration(retentionDays)*24*time.Hour)
+	visitorSecret := os.Getenv("VISITOR_ID_SECRET")
+	if visitorSecret == "" {
+		log.Println("Warning: VISITOR_ID_SECRET is not set, visitor IDs are hashed without a key")
+	}
+
+	server := NewAnalyticsServiceServer(redisClient, events, rollups, pb.NewURLServiceClient(urlConn), geo, loc, []byte(visitorSecret))
+	server.importLegacyUniques(ctx)
+
+	if *rebuildFrom != "" {
+		from, err := time.ParseInLocation("2006-01-02", *rebuildFrom, loc)
+		if err != nil {
+			log.Fatalf("Invalid -rebuild-from: %v", err)
+		}
+
+		to := time.Now()
+		if *rebuildTo != "" {
+			to, err = time.ParseInLocation("2006-01-02", *rebuildTo, loc)
+			if err != nil {
+				log.Fatalf("Invalid -rebuild-to: %v", err)
+			}
+		}
+
+		count, err := server.rebuildAggregates(ctx, from, to)
+		if err != nil {
+			log.Fatalf("Rebuild failed after %d clicks: %v", count, err)
+		}
+		log.Printf("Rebuilt aggregates from %d clicks", count)
+		return
+	}
+
+	rollupInterval := positiveIntEnv("ROLLUP_INTERVAL_MINUTES", 60)
+	rollupDayRetention := positiveIntEnv("ROLLUP_DAY_RETENTION_DAYS", 400)
+
+	worker := NewRollupWorker(redisClient, rollups, rollupDayRetention, loc)
+	go worker.Run(ctx, time.Duration(rollupInterval)*time.Minute)
+
 	lis, err := net.Listen("tcp", ":8082")
 	if err != nil {
 		log.Fatalf("Failed to listen: %v", err)
 	}
 
 	grpcServer := grpc.NewServer()
-	pb.RegisterAnalyticsServiceServer(grpcServer, NewAnalyticsServiceServer(redisClient))
+	pb.RegisterAnalyticsServiceServer(grpcServer, server)
 
 	log.Println("Analytics Service started on :8082")
 	if err := grpcServer.Serve(lis); err != nil {
 		log.Fatalf("Failed to serve: %v", err)
 	}
 }
+
+func positiveIntEnv(name string, fallback int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+
+	parsed, err := strconv.Atoi(value)
+	if err != nil || parsed <= 0 {
+		log.Printf("Ignoring %s=%s: must be a positive integer", name, value)
+		return fallback
+	}
+	return parsed
+}
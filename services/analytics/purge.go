@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	pb "github.com/gorgio/network/api/proto"
+	"github.com/redis/go-redis/v9"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// A short code that is deleted or renamed away can be taken by another link,
+// so its clicks are purged, or moved to the new code, instead of being left
+// for the next owner to read. The click event log cannot be edited cheaply; a
+// marker records when the code was given up, and reads of the log skip its
+// earlier events.
+
+func purgedKey(shortCode string) string {
+	return fmt.Sprintf("clicks:purged:%s", shortCode)
+}
+
+// PurgeClicks deletes everything counted for a short code. Only the URL
+// service calls it, once the link is deleted. Campaign stats are the owner's
+// and stay.
+func (s *AnalyticsServiceServer) PurgeClicks(ctx context.Context, req *pb.PurgeClicksRequest) (*pb.PurgeClicksResponse, error) {
+	log.Printf("PurgeClicks: short_code=%s", req.ShortCode)
+
+	if req.ShortCode == "" {
+		return nil, status.Error(codes.InvalidArgument, "short_code is required")
+	}
+
+	now := time.Now().In(s.loc)
+
+	// The marker goes first so the event log stops counting the code even
+	// if a later step fails.
+	if err := s.markPurged(ctx, req.ShortCode, now); err != nil {
+		log.Printf("Failed to mark %s purged: %v", req.ShortCode, err)
+		return nil, status.Error(codes.Internal, "failed to purge clicks")
+	}
+
+	state, err := s.rollups.State(ctx)
+	if err != nil {
+		log.Printf("Failed to read rollup state: %v", err)
+		return nil, status.Error(codes.Internal, "failed to purge clicks")
+	}
+
+	pipe := s.redis.Pipeline()
+	pipe.Del(ctx, linkKeys(req.ShortCode, now, state.FirstDay)...)
+	for _, key := range leaderboardKeys(now) {
+		pipe.ZRem(ctx, key, req.ShortCode)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("Failed to purge clicks of %s: %v", req.ShortCode, err)
+		return nil, status.Error(codes.Internal, "failed to purge clicks")
+	}
+
+	if err := s.rollups.DeleteLink(ctx, req.ShortCode); err != nil {
+		log.Printf("Failed to purge click rollups of %s: %v", req.ShortCode, err)
+		return nil, status.Error(codes.Internal, "failed to purge clicks")
+	}
+
+	return &pb.PurgeClicksResponse{Success: true}, nil
+}
+
+// RenameClicks moves everything counted for a short code to the code its link
+// was renamed to. Only the URL service calls it, after the rename. Logged
+// events stay under the old code, so the event log only counts the new one
+// from the rename on.
+func (s *AnalyticsServiceServer) RenameClicks(ctx context.Context, req *pb.RenameClicksRequest) (*pb.RenameClicksResponse, error) {
+	log.Printf("RenameClicks: short_code=%s, new_short_code=%s", req.ShortCode, req.NewShortCode)
+
+	if req.ShortCode == "" || req.NewShortCode == "" {
+		return nil, status.Error(codes.InvalidArgument, "short_code and new_short_code are required")
+	}
+
+	now := time.Now().In(s.loc)
+
+	if err := s.markPurged(ctx, req.ShortCode, now); err != nil {
+		log.Printf("Failed to mark %s purged: %v", req.ShortCode, err)
+		return nil, status.Error(codes.Internal, "failed to move clicks")
+	}
+
+	state, err := s.rollups.State(ctx)
+	if err != nil {
+		log.Printf("Failed to read rollup state: %v", err)
+		return nil, status.Error(codes.Internal, "failed to move clicks")
+	}
+
+	// linkKeys lists the keys of both codes in the same order.
+	from := linkKeys(req.ShortCode, now, state.FirstDay)
+	to := linkKeys(req.NewShortCode, now, state.FirstDay)
+
+	sets := leaderboardKeys(now)
+	if req.OwnerId != "" && req.Campaign != "" {
+		sets = append(sets, campaignKey(campaignURLs, req.OwnerId, req.Campaign))
+	}
+
+	pipe := s.redis.Pipeline()
+	exists := make([]*redis.IntCmd, len(from))
+	for i, key := range from {
+		exists[i] = pipe.Exists(ctx, key)
+	}
+	scores := make([]*redis.FloatCmd, len(sets))
+	for i, key := range sets {
+		scores[i] = pipe.ZScore(ctx, key, req.ShortCode)
+	}
+	// Codes missing from a sorted set fail their ZSCORE with redis.Nil, so
+	// each command's error is checked rather than the first one Exec returns.
+	pipe.Exec(ctx)
+	for _, cmd := range exists {
+		if err := cmd.Err(); err != nil {
+			log.Printf("Failed to read clicks of %s: %v", req.ShortCode, err)
+			return nil, status.Error(codes.Internal, "failed to move clicks")
+		}
+	}
+	for _, cmd := range scores {
+		if err := cmd.Err(); err != nil && err != redis.Nil {
+			log.Printf("Failed to read clicks of %s: %v", req.ShortCode, err)
+			return nil, status.Error(codes.Internal, "failed to move clicks")
+		}
+	}
+
+	move := s.redis.TxPipeline()
+	for i, cmd := range exists {
+		if cmd.Val() > 0 {
+			move.Rename(ctx, from[i], to[i])
+		}
+	}
+	for i, cmd := range scores {
+		if cmd.Err() == nil {
+			move.ZIncrBy(ctx, sets[i], cmd.Val(), req.NewShortCode)
+			move.ZRem(ctx, sets[i], req.ShortCode)
+		}
+	}
+	if _, err := move.Exec(ctx); err != nil {
+		log.Printf("Failed to move clicks of %s to %s: %v", req.ShortCode, req.NewShortCode, err)
+		return nil, status.Error(codes.Internal, "failed to move clicks")
+	}
+
+	if err := s.rollups.RenameLink(ctx, req.ShortCode, req.NewShortCode); err != nil {
+		log.Printf("Failed to move click rollups of %s to %s: %v", req.ShortCode, req.NewShortCode, err)
+		return nil, status.Error(codes.Internal, "failed to move clicks")
+	}
+
+	return &pb.RenameClicksResponse{Success: true}, nil
+}
+
+// markPurged stops the event log counting shortCode's events up to now. The
+// marker only has to outlive the logged events.
+func (s *AnalyticsServiceServer) markPurged(ctx context.Context, shortCode string, now time.Time) error {
+	return s.redis.Set(ctx, purgedKey(shortCode), now.Unix(), s.events.retention+48*time.Hour).Err()
+}
+
+// linkKeys lists every Redis key holding clicks of shortCode: the permanent
+// ones, the daily and hourly ones that can still be alive at now, and the
+// monthly visitors of every month since rollups began at firstDay.
+func linkKeys(shortCode string, now, firstDay time.Time) []string {
+	keys := []string{
+		fmt.Sprintf("clicks:total:%s", shortCode),
+		fmt.Sprintf("clicks:bot:%s", shortCode),
+		fmt.Sprintf("clicks:visitors:%s", shortCode),
+		refererKey(shortCode, refererGroupURL),
+		refererKey(shortCode, refererGroupDomain),
+		geoKey(shortCode, geoLevelCountry),
+		geoKey(shortCode, geoLevelCity),
+	}
+	for _, dimension := range []string{dimensionDevice, dimensionOS, dimensionBrowser, dimensionBot} {
+		keys = append(keys, breakdownKey(shortCode, dimension))
+	}
+
+	// Counters live counterDays after their last increment, which was on
+	// the day they count.
+	today := startOfDay(now)
+	for day := today.AddDate(0, 0, -counterDays); !day.After(today); day = day.AddDate(0, 0, 1) {
+		date := day.Format("2006-01-02")
+		keys = append(keys,
+			fmt.Sprintf("clicks:daily:%s:%s", shortCode, date),
+			dayVisitorsKey(shortCode, day))
+		for hour := 0; hour < 24; hour++ {
+			keys = append(keys, fmt.Sprintf("clicks:hourly:%s:%s-%02d", shortCode, date, hour))
+		}
+	}
+
+	if !firstDay.IsZero() {
+		for month := startOfMonth(firstDay); !month.After(now); month = month.AddDate(0, 1, 0) {
+			keys = append(keys, monthVisitorsKey(shortCode, month))
+		}
+	}
+
+	return keys
+}
+
+// leaderboardKeys lists the global leaderboards that can still be alive at
+// now, going by the lifetimes recordAggregates gives them.
+func leaderboardKeys(now time.Time) []string {
+	keys := []string{globalAllKey}
+
+	today := startOfDay(now)
+	for i := 0; i <= globalDays; i++ {
+		keys = append(keys, globalDayKey(today.AddDate(0, 0, -i)))
+	}
+	for i := 0; i <= 90/7+1; i++ {
+		keys = append(keys, globalWeekKey(today.AddDate(0, 0, -7*i)))
+	}
+	thisMonth := startOfMonth(now)
+	for i := 0; i <= 180/28; i++ {
+		keys = append(keys, globalMonthKey(thisMonth.AddDate(0, -i, 0)))
+	}
+
+	return keys
+}
+
+// purgedAt returns when shortCode was last purged, in Unix seconds, or 0 if
+// its logged events are all its own.
+func (s *AnalyticsServiceServer) purgedAt(ctx context.Context, shortCode string) (int64, error) {
+	value, err := s.redis.Get(ctx, purgedKey(shortCode)).Int64()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	return value, err
+}
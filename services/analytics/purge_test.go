@@ -0,0 +1,37 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLinkKeysPairUpAcrossCodes(t *testing.T) {
+	now := time.Date(2026, 3, 15, 12, 0, 0, 0, time.UTC)
+	firstDay := time.Date(2025, 11, 20, 0, 0, 0, 0, time.UTC)
+
+	from := linkKeys("old123", now, firstDay)
+	to := linkKeys("new456", now, firstDay)
+	if len(from) != len(to) {
+		t.Fatalf("got %d keys for the old code and %d for the new one", len(from), len(to))
+	}
+
+	for i := range from {
+		if want := strings.Replace(from[i], "old123", "new456", 1); to[i] != want {
+			t.Errorf("key %d: %s would be renamed to %s, want %s", i, from[i], to[i], want)
+		}
+	}
+
+	for _, key := range []string{
+		"clicks:total:old123",
+		"clicks:hourly:old123:2026-02-13-00",
+		"clicks:daily:old123:2026-03-15",
+		"clicks:visitors:old123:2025-11",
+		"clicks:visitors:old123:2026-03",
+	} {
+		if !slices.Contains(from, key) {
+			t.Errorf("linkKeys is missing %s", key)
+		}
+	}
+}
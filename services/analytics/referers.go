@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Ways GetTopReferers can group referers.
+const (
+	refererGroupURL    = "url"
+	refererGroupDomain = "domain"
+)
+
+func refererKey(shortCode, groupBy string) string {
+	return fmt.Sprintf("clicks:referers:%s:%s", groupBy, shortCode)
+}
+
+// refererAliases folds the hosts a site sends traffic from, including its
+// link shorteners and redirectors, into one source name.
+var refererAliases = map[string]string{
+	"t.co":                  "twitter",
+	"twitter.com":           "twitter",
+	"mobile.twitter.com":    "twitter",
+	"x.com":                 "twitter",
+	"facebook.com":          "facebook",
+	"l.facebook.com":        "facebook",
+	"lm.facebook.com":       "facebook",
+	"m.facebook.com":        "facebook",
+	"fb.me":                 "facebook",
+	"instagram.com":         "instagram",
+	"l.instagram.com":       "instagram",
+	"linkedin.com":          "linkedin",
+	"lnkd.in":               "linkedin",
+	"reddit.com":            "reddit",
+	"old.reddit.com":        "reddit",
+	"out.reddit.com":        "reddit",
+	"news.ycombinator.com":  "hackernews",
+	"youtube.com":           "youtube",
+	"m.youtube.com":         "youtube",
+	"youtu.be":              "youtube",
+	"t.me":                  "telegram",
+	"web.telegram.org":      "telegram",
+	"com.slack":             "slack",
+	"app.slack.com":         "slack",
+	"mail.google.com":       "gmail",
+	"com.google.android.gm": "gmail",
+	"duckduckgo.com":        "duckduckgo",
+	"bing.com":              "bing",
+}
+
+// normalizeReferer reduces a Referer header to its source domain and its
+// page URL without query string or fragment, with the host lowercased and a
+// leading "www." dropped. ok is false for headers that are not absolute URLs.
+func normalizeReferer(raw string) (domain, pageURL string, ok bool) {
+	parsed, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil || parsed.Scheme == "" || parsed.Hostname() == "" {
+		return "", "", false
+	}
+
+	host := strings.TrimPrefix(strings.ToLower(parsed.Hostname()), "www.")
+	scheme := strings.ToLower(parsed.Scheme)
+
+	path := parsed.EscapedPath()
+	if path == "/" {
+		path = ""
+	}
+	pageURL = scheme + "://" + host + path
+
+	domain = host
+	if alias, found := refererAliases[host]; found {
+		domain = alias
+	} else if isGoogleHost(host) {
+		domain = "google"
+	}
+
+	return domain, pageURL, true
+}
+
+// isGoogleHost matches google.com and the country sites like google.co.uk.
+func isGoogleHost(host string) bool {
+	return strings.HasPrefix(host, "google.") || strings.Contains(host, ".google.")
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/gorgio/network/pkg/database"
+	"github.com/redis/go-redis/v9"
+)
+
+// RollupWorker moves per-link counts into PostgreSQL before their Redis
+// counters expire. Each finished day's hourly counters are summed into a day
+// row, each finished month of day rows into a month row, and day rows older
+// than the retention are pruned once their month is rolled up. Daily visitor
+// HyperLogLogs are merged into monthly ones that never expire.
+type RollupWorker struct {
+	redis        *redis.Client
+	rollups      *database.ClickRollupDB
+	dayRetention int
+	loc          *time.Location
+}
+
+func NewRollupWorker(redisClient *redis.Client, rollups *database.ClickRollupDB, dayRetention int, loc *time.Location) *RollupWorker {
+	return &RollupWorker{
+		redis:        redisClient,
+		rollups:      rollups,
+		dayRetention: dayRetention,
+		loc:          loc,
+	}
+}
+
+// Run rolls up on start and then once per interval until ctx is done.
+func (w *RollupWorker) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := w.rollUp(ctx, time.Now().In(w.loc)); err != nil {
+			log.Printf("Click rollup failed: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (w *RollupWorker) rollUp(ctx context.Context, now time.Time) error {
+	state, err := w.rollups.State(ctx)
+	if err != nil {
+		return err
+	}
+
+	today := startOfDay(now)
+	countersFrom := today.AddDate(0, 0, -(counterDays - 1))
+
+	day := countersFrom
+	if !state.DaysThrough.IsZero() {
+		next := state.DaysThrough.AddDate(0, 0, 1)
+		if next.Before(countersFrom) {
+			log.Printf("Click rollup fell behind: counters from %s to %s already expired",
+				next.Format("2006-01-02"), countersFrom.AddDate(0, 0, -1).Format("2006-01-02"))
+		} else {
+			day = next
+		}
+	}
+
+	for ; day.Before(today); day = day.AddDate(0, 0, 1) {
+		counts, err := w.dayCounts(ctx, day)
+		if err != nil {
+			return fmt.Errorf("day %s: %w", day.Format("2006-01-02"), err)
+		}
+
+		if err := w.rollups.SaveDay(ctx, day, counts); err != nil {
+			return fmt.Errorf("day %s: %w", day.Format("2006-01-02"), err)
+		}
+
+		if err := w.mergeVisitors(ctx, day, counts); err != nil {
+			return fmt.Errorf("day %s: %w", day.Format("2006-01-02"), err)
+		}
+
+		if next := day.AddDate(0, 0, 1); next.Day() == 1 {
+			month := startOfMonth(day)
+			if err := w.rollups.RollUpMonth(ctx, month); err != nil {
+				return fmt.Errorf("month %s: %w", month.Format("2006-01"), err)
+			}
+		}
+
+		log.Printf("Rolled up clicks for %s: %d links", day.Format("2006-01-02"), len(counts))
+	}
+
+	return w.pruneDays(ctx, today)
+}
+
+// pruneDays drops day rows older than the retention, a whole month at a
+// time and only for months that already have their month rows.
+func (w *RollupWorker) pruneDays(ctx context.Context, today time.Time) error {
+	state, err := w.rollups.State(ctx)
+	if err != nil {
+		return err
+	}
+	if state.MonthsThrough.IsZero() {
+		return nil
+	}
+
+	before := startOfMonth(today.AddDate(0, 0, -w.dayRetention))
+	if rolled := state.MonthsThrough.AddDate(0, 1, 0); before.After(rolled) {
+		before = rolled
+	}
+
+	if !before.After(state.DaysFrom) {
+		return nil
+	}
+	return w.rollups.PruneDays(ctx, before)
+}
+
+// dayCounts sums the hourly counters of every link clicked on day.
+func (w *RollupWorker) dayCounts(ctx context.Context, day time.Time) (map[string]int64, error) {
+	date := day.Format("2006-01-02")
+	prefix := "clicks:daily:"
+	suffix := ":" + date
+
+	// SCAN may return a key more than once.
+	seen := make(map[string]bool)
+	var shortCodes []string
+	iter := w.redis.Scan(ctx, 0, prefix+"*"+suffix, 1000).Iterator()
+	for iter.Next(ctx) {
+		shortCode := strings.TrimSuffix(strings.TrimPrefix(iter.Val(), prefix), suffix)
+		if !seen[shortCode] {
+			seen[shortCode] = true
+			shortCodes = append(shortCodes, shortCode)
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, 0, len(shortCodes)*24)
+	for _, shortCode := range shortCodes {
+		for hour := 0; hour < 24; hour++ {
+			keys = append(keys, fmt.Sprintf("clicks:hourly:%s:%s-%02d", shortCode, date, hour))
+		}
+	}
+
+	values, err := mgetCounts(ctx, w.redis, keys)
+	if err != nil {
+		return nil, err
+	}
+
+	counts := make(map[string]int64, len(shortCodes))
+	for i, shortCode := range shortCodes {
+		var total int64
+		for _, value := range values[i*24 : (i+1)*24] {
+			total += value
+		}
+		if total > 0 {
+			counts[shortCode] = total
+		}
+	}
+
+	return counts, nil
+}
+
+// mergeVisitors adds the day's visitors of each link to the link's monthly
+// HyperLogLog. Merging is idempotent, so a day rolled up twice is harmless.
+func (w *RollupWorker) mergeVisitors(ctx context.Context, day time.Time, counts map[string]int64) error {
+	pipe := w.redis.Pipeline()
+	for shortCode := range counts {
+		pipe.PFMerge(ctx, monthVisitorsKey(shortCode, day), dayVisitorsKey(shortCode, day))
+
+		if pipe.Len() >= 1000 {
+			if _, err := pipe.Exec(ctx); err != nil {
+				return err
+			}
+		}
+	}
+
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+func startOfMonth(t time.Time) time.Time {
+	year, month, _ := t.Date()
+	return time.Date(year, month, 1, 0, 0, 0, 0, t.Location())
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	pb "github.com/gorgio/network/api/proto"
+	"github.com/gorgio/network/pkg/database"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	granularityHour  = "hour"
+	granularityDay   = "day"
+	granularityWeek  = "week"
+	granularityMonth = "month"
+)
+
+const (
+	// counterDays is how long the per-link daily and hourly counters live
+	// after their last increment.
+	counterDays = 30
+
+	defaultStatsDays   = 7
+	maxHourlyStatsDays = 31
+	maxStatsDays       = 3660
+	mgetBatch          = 500
+)
+
+// statsRange covers whole days in the analytics timezone, from inclusive and
+// to exclusive.
+type statsRange struct {
+	from        time.Time
+	to          time.Time
+	granularity string
+}
+
+func parseStatsRange(req *pb.GetClickStatsRequest, now time.Time) (*statsRange, error) {
+	granularity := req.Granularity
+	if granularity == "" {
+		granularity = granularityDay
+	}
+	switch granularity {
+	case granularityHour, granularityDay, granularityWeek, granularityMonth:
+	default:
+		return nil, fmt.Errorf("granularity must be hour, day, week or month")
+	}
+
+	to := startOfDay(now)
+	if req.To != "" {
+		parsed, err := time.ParseInLocation("2006-01-02", req.To, now.Location())
+		if err != nil {
+			return nil, fmt.Errorf("to must be a YYYY-MM-DD date")
+		}
+		to = parsed
+	}
+
+	from := to.AddDate(0, 0, -(defaultStatsDays - 1))
+	if req.From != "" {
+		parsed, err := time.ParseInLocation("2006-01-02", req.From, now.Location())
+		if err != nil {
+			return nil, fmt.Errorf("from must be a YYYY-MM-DD date")
+		}
+		from = parsed
+	}
+
+	if from.After(to) {
+		return nil, fmt.Errorf("from must not be after to")
+	}
+	to = to.AddDate(0, 0, 1)
+
+	limit := maxStatsDays
+	if granularity == granularityHour {
+		limit = maxHourlyStatsDays
+	}
+	if days := int(math.Round(to.Sub(from).Hours() / 24)); days > limit {
+		return nil, fmt.Errorf("range must not exceed %d days at %s granularity", limit, granularity)
+	}
+
+	return &statsRange{
+		from:        from,
+		to:          to,
+		granularity: granularity,
+	}, nil
+}
+
+// slots lists the start of every counter period in the range, newest first.
+// Hour granularity reads the hourly counters, everything else the daily ones.
+func (r *statsRange) slots() []time.Time {
+	var slots []time.Time
+	for t := r.from; t.Before(r.to); t = r.nextSlot(t) {
+		slots = append(slots, t)
+	}
+	for i, j := 0, len(slots)-1; i < j; i, j = i+1, j-1 {
+		slots[i], slots[j] = slots[j], slots[i]
+	}
+	return slots
+}
+
+func (r *statsRange) nextSlot(t time.Time) time.Time {
+	if r.granularity == granularityHour {
+		return t.Add(time.Hour)
+	}
+	return t.AddDate(0, 0, 1)
+}
+
+func (r *statsRange) counterKey(shortCode string, slot time.Time) string {
+	if r.granularity == granularityHour {
+		return fmt.Sprintf("clicks:hourly:%s:%s", shortCode, slot.Format("2006-01-02-15"))
+	}
+	return fmt.Sprintf("clicks:daily:%s:%s", shortCode, slot.Format("2006-01-02"))
+}
+
+// slotOf truncates a click time to the start of its counter period.
+func (r *statsRange) slotOf(t time.Time) time.Time {
+	if r.granularity == granularityHour {
+		return t.Truncate(time.Hour)
+	}
+	return startOfDay(t)
+}
+
+func (r *statsRange) bucketLabel(slot time.Time) string {
+	switch r.granularity {
+	case granularityHour:
+		return slot.Format("2006-01-02T15")
+	case granularityWeek:
+		year, week := slot.ISOWeek()
+		return fmt.Sprintf("%d-W%02d", year, week)
+	case granularityMonth:
+		return slot.Format("2006-01")
+	default:
+		return slot.Format("2006-01-02")
+	}
+}
+
+// clickCounts holds the clicks found for a range. Months read from the month
+// rollup tier are counted as a whole because their days are gone.
+type clickCounts struct {
+	slots     map[int64]int64  // by slot unix start
+	months    map[string]int64 // by month bucket label
+	truncated bool
+}
+
+// clickBuckets sums per-slot counts into the requested granularity. slots
+// are newest first, so equal labels are always adjacent.
+func (r *statsRange) clickBuckets(slots []time.Time, counts *clickCounts) []*pb.ClickBucket {
+	var buckets []*pb.ClickBucket
+	for _, slot := range slots {
+		label := r.bucketLabel(slot)
+		monthTotal, wholeMonth := counts.months[label]
+
+		if len(buckets) == 0 || buckets[len(buckets)-1].Period != label {
+			buckets = append(buckets, &pb.ClickBucket{Period: label, Count: monthTotal})
+		}
+		if !wholeMonth {
+			buckets[len(buckets)-1].Count += counts.slots[slot.Unix()]
+		}
+	}
+	return buckets
+}
+
+// countClicks reads every slot from the freshest tier that still has it:
+// the Redis counters for the last counterDays days, then the day and month
+// rollups, then the click event log. Slots none of them cover mark the
+// result truncated.
+func (s *AnalyticsServiceServer) countClicks(ctx context.Context, shortCode string, r *statsRange, slots []time.Time, now time.Time) (*clickCounts, error) {
+	counts := &clickCounts{
+		slots:  make(map[int64]int64, len(slots)),
+		months: make(map[string]int64),
+	}
+
+	// Counters for today and the days just before it cannot have expired yet.
+	countersFrom := startOfDay(now).AddDate(0, 0, -(counterDays - 1))
+
+	var live, old []time.Time
+	for _, slot := range slots {
+		if slot.Before(countersFrom) {
+			old = append(old, slot)
+		} else {
+			live = append(live, slot)
+		}
+	}
+
+	keys := make([]string, len(live))
+	for i, slot := range live {
+		keys[i] = r.counterKey(shortCode, slot)
+	}
+
+	values, err := mgetCounts(ctx, s.redis, keys)
+	if err != nil {
+		return nil, err
+	}
+	for i, slot := range live {
+		counts.slots[slot.Unix()] = values[i]
+	}
+
+	if len(old) == 0 {
+		return counts, nil
+	}
+
+	state, err := s.rollups.State(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	eventsFrom := now.Add(-s.events.retention)
+
+	var daySlots, monthStarts, eventSlots []time.Time
+	for _, slot := range old {
+		switch {
+		case r.granularity != granularityHour && inDayTier(state, slot):
+			daySlots = append(daySlots, slot)
+		case r.granularity == granularityMonth && inMonthTier(state, r, slot):
+			month := startOfMonth(slot)
+			if len(monthStarts) == 0 || !monthStarts[len(monthStarts)-1].Equal(month) {
+				monthStarts = append(monthStarts, month)
+			}
+		case !slot.Before(eventsFrom):
+			eventSlots = append(eventSlots, slot)
+		default:
+			counts.truncated = true
+		}
+	}
+
+	// Slots are newest first, so each list runs from its last element to
+	// the end of its first.
+	if len(daySlots) > 0 {
+		rows, err := s.rollups.Counts(ctx, shortCode, database.RollupDay,
+			daySlots[len(daySlots)-1], daySlots[0].AddDate(0, 0, 1))
+		if err != nil {
+			return nil, err
+		}
+		for _, slot := range daySlots {
+			counts.slots[slot.Unix()] = rows[slot.Format("2006-01-02")]
+		}
+	}
+
+	if len(monthStarts) > 0 {
+		rows, err := s.rollups.Counts(ctx, shortCode, database.RollupMonth,
+			monthStarts[len(monthStarts)-1], monthStarts[0].AddDate(0, 1, 0))
+		if err != nil {
+			return nil, err
+		}
+		for _, month := range monthStarts {
+			counts.months[r.bucketLabel(month)] = rows[month.Format("2006-01-02")]
+		}
+	}
+
+	if len(eventSlots) > 0 {
+		wanted := make(map[int64]bool, len(eventSlots))
+		for _, slot := range eventSlots {
+			wanted[slot.Unix()] = true
+		}
+
+		// Events up to a purge belong to an earlier link with this code.
+		purged, err := s.purgedAt(ctx, shortCode)
+		if err != nil {
+			return nil, err
+		}
+
+		from := eventSlots[len(eventSlots)-1]
+		to := r.nextSlot(eventSlots[0])
+		err = s.events.Range(ctx, from, to, func(click *ClickData) error {
+			if click.Timestamp > purged {
+				r.countEvent(counts, shortCode, wanted, now.Location(), click)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return counts, nil
+}
+
+// countEvent adds a logged click to its slot if it is a human click on
+// shortCode in one of the wanted slots. Bot hits only count as bot_clicks.
+func (r *statsRange) countEvent(counts *clickCounts, shortCode string, wanted map[int64]bool, loc *time.Location, click *ClickData) {
+	if click.ShortCode != shortCode || click.IsBot {
+		return
+	}
+
+	slot := r.slotOf(time.Unix(click.Timestamp, 0).In(loc)).Unix()
+	if wanted[slot] {
+		counts.slots[slot]++
+	}
+}
+
+func inDayTier(state *database.RollupState, day time.Time) bool {
+	return !state.DaysFrom.IsZero() && !day.Before(state.DaysFrom) && !day.After(state.DaysThrough)
+}
+
+// inMonthTier reports whether day's month has a complete month row and lies
+// wholly inside the range, so the row can stand in for its days.
+func inMonthTier(state *database.RollupState, r *statsRange, day time.Time) bool {
+	month := startOfMonth(day)
+	return !state.MonthsThrough.IsZero() &&
+		!month.After(state.MonthsThrough) &&
+		!month.Before(state.FirstDay) &&
+		!month.Before(r.from) &&
+		!month.AddDate(0, 1, 0).After(r.to)
+}
+
+// mgetCounts reads integer counters in pipelined MGET batches. Missing keys
+// count as zero.
+func mgetCounts(ctx context.Context, redisClient *redis.Client, keys []string) ([]int64, error) {
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	pipe := redisClient.Pipeline()
+	cmds := make([]*redis.SliceCmd, 0, (len(keys)+mgetBatch-1)/mgetBatch)
+	for start := 0; start < len(keys); start += mgetBatch {
+		end := min(start+mgetBatch, len(keys))
+		cmds = append(cmds, pipe.MGet(ctx, keys[start:end]...))
+	}
+
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+
+	counts := make([]int64, 0, len(keys))
+	for _, cmd := range cmds {
+		for _, value := range cmd.Val() {
+			var count int64
+			if str, ok := value.(string); ok {
+				count, _ = strconv.ParseInt(str, 10, 64)
+			}
+			counts = append(counts, count)
+		}
+	}
+	return counts, nil
+}
+
+func startOfDay(t time.Time) time.Time {
+	year, month, day := t.Date()
+	return time.Date(year, month, day, 0, 0, 0, 0, t.Location())
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCountEventSkipsBots(t *testing.T) {
+	loc := time.UTC
+	day := time.Date(2025, 3, 10, 0, 0, 0, 0, loc)
+	r := &statsRange{from: day, to: day.AddDate(0, 0, 2), granularity: granularityDay}
+
+	wanted := map[int64]bool{}
+	for _, slot := range r.slots() {
+		wanted[slot.Unix()] = true
+	}
+
+	at := func(d time.Time, hour int) int64 {
+		return d.Add(time.Duration(hour) * time.Hour).Unix()
+	}
+	next := day.AddDate(0, 0, 1)
+
+	events := []*ClickData{
+		{ShortCode: "abc123", Timestamp: at(day, 9)},
+		{ShortCode: "abc123", Timestamp: at(day, 10), IsBot: true},
+		{ShortCode: "abc123", Timestamp: at(day, 11)},
+		{ShortCode: "abc123", Timestamp: at(next, 1), IsBot: true},
+		{ShortCode: "abc123", Timestamp: at(next, 2)},
+		{ShortCode: "other1", Timestamp: at(next, 3)},
+		{ShortCode: "abc123", Timestamp: at(next.AddDate(0, 0, 1), 4)},
+	}
+
+	counts := &clickCounts{slots: map[int64]int64{}}
+	for _, click := range events {
+		r.countEvent(counts, "abc123", wanted, loc, click)
+	}
+
+	tests := []struct {
+		slot time.Time
+		want int64
+	}{
+		{day, 2},
+		{next, 1},
+	}
+	for _, tt := range tests {
+		if got := counts.slots[tt.slot.Unix()]; got != tt.want {
+			t.Errorf("slot %s: got %d clicks, want %d", tt.slot.Format("2006-01-02"), got, tt.want)
+		}
+	}
+	if len(counts.slots) != len(tests) {
+		t.Errorf("counted %d slots, want %d", len(counts.slots), len(tests))
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	pb "github.com/gorgio/network/api/proto"
+	"github.com/redis/go-redis/v9"
+)
+
+// Global leaderboards are sorted sets of short codes scored by clicks: one
+// for all time and one per day, ISO week and calendar month in the analytics
+// timezone. Any other span of days is the union of its day sets.
+
+const (
+	periodAll   = "all"
+	periodDay   = "day"
+	periodWeek  = "week"
+	periodMonth = "month"
+	periodRange = "range"
+)
+
+const (
+	// globalDays is how long the per-day leaderboards live, and so how far
+	// back a range may reach.
+	globalDays = 90
+
+	// rangeUnionTTL bounds how long a range union outlives the request that
+	// built it.
+	rangeUnionTTL = time.Minute
+)
+
+const globalAllKey = "clicks:global:sorted"
+
+func globalDayKey(day time.Time) string {
+	return fmt.Sprintf("clicks:global:day:%s", day.Format("2006-01-02"))
+}
+
+// globalWeekKey names the ISO week leaderboard. Older releases wrote
+// clicks:global:week:<year>-W<month> keys, so ISO weeks get their own prefix
+// instead of sharing names with those.
+func globalWeekKey(t time.Time) string {
+	year, week := t.ISOWeek()
+	return fmt.Sprintf("clicks:global:isoweek:%d-W%02d", year, week)
+}
+
+func globalMonthKey(t time.Time) string {
+	return fmt.Sprintf("clicks:global:month:%s", t.Format("2006-01"))
+}
+
+// globalKey returns the leaderboard for a fixed period containing now.
+// Unknown periods fall back to all time.
+func globalKey(period string, now time.Time) string {
+	switch period {
+	case periodDay:
+		return globalDayKey(now)
+	case periodWeek:
+		return globalWeekKey(now)
+	case periodMonth:
+		return globalMonthKey(now)
+	default:
+		return globalAllKey
+	}
+}
+
+// parseTopRange returns the whole days, from inclusive and to exclusive, that
+// a range request covers. Dates are read the same way as for GetClickStats.
+func parseTopRange(req *pb.GetTopURLsRequest, now time.Time) (time.Time, time.Time, error) {
+	today := startOfDay(now)
+	oldest := today.AddDate(0, 0, -(globalDays - 1))
+
+	if req.Days < 0 || req.Days > globalDays {
+		return time.Time{}, time.Time{}, fmt.Errorf("days must be between 1 and %d", globalDays)
+	}
+	if req.Days > 0 {
+		return today.AddDate(0, 0, -(int(req.Days) - 1)), today.AddDate(0, 0, 1), nil
+	}
+
+	r, err := parseStatsRange(&pb.GetClickStatsRequest{From: req.From, To: req.To}, now)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	if r.from.Before(oldest) {
+		return time.Time{}, time.Time{}, fmt.Errorf("from must be within the last %d days", globalDays)
+	}
+	return r.from, r.to, nil
+}
+
+// topInRange ranks links by their clicks over the days in [from, to) by
+// storing the union of the day leaderboards under a short-lived key.
+func (s *AnalyticsServiceServer) topInRange(ctx context.Context, from, to time.Time, limit int64) ([]redis.Z, error) {
+	var keys []string
+	for day := from; day.Before(to); day = day.AddDate(0, 0, 1) {
+		keys = append(keys, globalDayKey(day))
+	}
+
+	unionKey := fmt.Sprintf("clicks:global:range:%s:%s", from.Format("2006-01-02"), to.AddDate(0, 0, -1).Format("2006-01-02"))
+
+	pipe := s.redis.TxPipeline()
+	pipe.ZUnionStore(ctx, unionKey, &redis.ZStore{Keys: keys})
+	pipe.Expire(ctx, unionKey, rangeUnionTTL)
+	results := pipe.ZRevRangeWithScores(ctx, unionKey, 0, limit-1)
+
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+	return results.Val(), nil
+}
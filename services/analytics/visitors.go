@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	pb "github.com/gorgio/network/api/proto"
+	"github.com/redis/go-redis/v9"
+)
+
+// Unique visitors are counted with HyperLogLogs: one per link for all time,
+// one per link and day that expires with the other daily counters, and one
+// per link and month that the rollup worker merges the days into.
+
+// hashVisitorID turns the identity the gateway sent, which is a bare IP address
+// by default, into the opaque ID that is counted and logged.
+func (s *AnalyticsServiceServer) hashVisitorID(id string) string {
+	mac := hmac.New(sha256.New, s.visitorSecret)
+	mac.Write([]byte(id))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+func dayVisitorsKey(shortCode string, day time.Time) string {
+	return fmt.Sprintf("clicks:visitors:%s:%s", shortCode, day.Format("2006-01-02"))
+}
+
+func monthVisitorsKey(shortCode string, month time.Time) string {
+	return fmt.Sprintf("clicks:visitors:%s:%s", shortCode, month.Format("2006-01"))
+}
+
+// visitorKeys lists the HyperLogLogs whose union covers the days in
+// [from, to): the day ones that have not expired and the month ones for months
+// wholly inside the span. Older days of partial months are not covered.
+func visitorKeys(shortCode string, from, to, countersFrom time.Time) []string {
+	var keys []string
+	for day := from; day.Before(to); day = day.AddDate(0, 0, 1) {
+		if !day.Before(countersFrom) {
+			keys = append(keys, dayVisitorsKey(shortCode, day))
+		}
+		if day.Day() == 1 && !day.AddDate(0, 1, 0).After(to) {
+			keys = append(keys, monthVisitorsKey(shortCode, day))
+		}
+	}
+	return keys
+}
+
+// countVisitors fills in each bucket's distinct visitors and returns those of
+// the whole range. PFCOUNT over several keys counts their union, so nothing is
+// counted twice across days and months.
+func (s *AnalyticsServiceServer) countVisitors(ctx context.Context, shortCode string, r *statsRange, slots []time.Time, buckets []*pb.ClickBucket, now time.Time) (int64, error) {
+	countersFrom := startOfDay(now).AddDate(0, 0, -(counterDays - 1))
+
+	pipe := s.redis.Pipeline()
+	var rangeCmd *redis.IntCmd
+	if keys := visitorKeys(shortCode, r.from, r.to, countersFrom); len(keys) > 0 {
+		rangeCmd = pipe.PFCount(ctx, keys...)
+	}
+
+	bucketCmds := make([]*redis.IntCmd, len(buckets))
+	if r.granularity != granularityHour {
+		// Slots are newest first and grouped by bucket, in bucket order.
+		i := 0
+		for b, bucket := range buckets {
+			newest := slots[i]
+			for i < len(slots) && r.bucketLabel(slots[i]) == bucket.Period {
+				i++
+			}
+			oldest := slots[i-1]
+
+			if keys := visitorKeys(shortCode, oldest, r.nextSlot(newest), countersFrom); len(keys) > 0 {
+				bucketCmds[b] = pipe.PFCount(ctx, keys...)
+			}
+		}
+	}
+
+	if pipe.Len() == 0 {
+		return 0, nil
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return 0, err
+	}
+
+	for b, cmd := range bucketCmds {
+		if cmd != nil {
+			buckets[b].Unique = cmd.Val()
+		}
+	}
+
+	if rangeCmd == nil {
+		return 0, nil
+	}
+	return rangeCmd.Val(), nil
+}
+
+// importLegacyUniques moves visitors from the sets older releases kept under
+// clicks:unique:* into the HyperLogLogs and deletes the sets, which held raw
+// IP addresses. The addresses are hashed like new visitors are, so a visitor
+// who returns is not counted again.
+func (s *AnalyticsServiceServer) importLegacyUniques(ctx context.Context) {
+	iter := s.redis.Scan(ctx, 0, "clicks:unique:*", 0).Iterator()
+	count := 0
+
+	for iter.Next(ctx) {
+		key := iter.Val()
+		members, err := s.redis.SMembers(ctx, key).Result()
+		if err != nil {
+			log.Printf("Failed to read legacy unique set %s: %v", key, err)
+			continue
+		}
+
+		shortCode := strings.TrimPrefix(key, "clicks:unique:")
+		visitors := make([]interface{}, len(members))
+		for i, member := range members {
+			visitors[i] = s.hashVisitorID(member)
+		}
+
+		pipe := s.redis.TxPipeline()
+		if len(visitors) > 0 {
+			pipe.PFAdd(ctx, fmt.Sprintf("clicks:visitors:%s", shortCode), visitors...)
+		}
+		pipe.Del(ctx, key)
+		if _, err := pipe.Exec(ctx); err != nil {
+			log.Printf("Failed to import legacy unique set %s: %v", key, err)
+			continue
+		}
+		count++
+	}
+
+	if err := iter.Err(); err != nil {
+		log.Printf("Failed to scan legacy unique sets: %v", err)
+	}
+	if count > 0 {
+		log.Printf("Imported %d legacy unique visitor sets", count)
+	}
+}
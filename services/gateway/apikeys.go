@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorgio/network/pkg/auth"
+	"github.com/gorgio/network/pkg/database"
+	"github.com/gorgio/network/pkg/middleware"
+	"github.com/gorgio/network/pkg/validator"
+)
+
+const (
+	maxAPIKeysPerUser = 20
+	maxAPIKeyName     = 100
+)
+
+type apiKeyResponse struct {
+	ID         int64    `json:"id"`
+	Name       string   `json:"name"`
+	Prefix     string   `json:"prefix"`
+	Scopes     []string `json:"scopes"`
+	CreatedAt  int64    `json:"created_at"`
+	LastUsedAt int64    `json:"last_used_at,omitempty"`
+	Key        string   `json:"key,omitempty"` // only set when the key is created
+}
+
+func newAPIKeyResponse(key *database.APIKey) *apiKeyResponse {
+	return &apiKeyResponse{
+		ID:         key.ID,
+		Name:       key.Name,
+		Prefix:     key.Prefix,
+		Scopes:     key.Scopes,
+		CreatedAt:  key.CreatedAt,
+		LastUsedAt: key.LastUsedAt,
+	}
+}
+
+// parseScopes checks requested scopes and drops duplicates.
+func parseScopes(requested []string) ([]string, error) {
+	var scopes []string
+	seen := make(map[string]bool)
+
+	for _, scope := range requested {
+		if !auth.ValidScope(scope) {
+			return nil, fmt.Errorf("unknown scope %q, must be one of %s", scope, strings.Join(auth.Scopes, ", "))
+		}
+		if !seen[scope] {
+			seen[scope] = true
+			scopes = append(scopes, scope)
+		}
+	}
+
+	if len(scopes) == 0 {
+		return nil, fmt.Errorf("at least one scope is required")
+	}
+
+	return scopes, nil
+}
+
+// handleAPIKeys lists the caller's API keys or creates one. Its route only
+// accepts JWTs, so a leaked key cannot create more.
+func (g *Gateway) handleAPIKeys(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	claims := middleware.ClaimsFromContext(r.Context())
+
+	if r.Method == http.MethodPost {
+		g.handleCreateAPIKey(w, r, claims.UserID)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	keys, err := g.apiKeys.List(ctx, claims.UserID)
+	if err != nil {
+		log.Printf("Error listing API keys: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	resp := make([]*apiKeyResponse, 0, len(keys))
+	for _, key := range keys {
+		resp = append(resp, newAPIKeyResponse(key))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"keys": resp,
+	})
+}
+
+func (g *Gateway) handleCreateAPIKey(w http.ResponseWriter, r *http.Request, userID string) {
+	var req struct {
+		Name   string   `json:"name"`
+		Scopes []string `json:"scopes"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	req.Name = validator.SanitizeInput(req.Name)
+	if utf8.RuneCountInString(req.Name) > maxAPIKeyName {
+		http.Error(w, fmt.Sprintf("Name must be at most %d characters", maxAPIKeyName), http.StatusBadRequest)
+		return
+	}
+
+	scopes, err := parseScopes(req.Scopes)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	count, err := g.apiKeys.CountActive(ctx, userID)
+	if err != nil {
+		log.Printf("Error counting API keys: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if count >= maxAPIKeysPerUser {
+		http.Error(w, fmt.Sprintf("At most %d API keys are allowed, revoke one first", maxAPIKeysPerUser), http.StatusConflict)
+		return
+	}
+
+	key, keyHash, err := auth.NewAPIKey()
+	if err != nil {
+		http.Error(w, "Failed to generate API key", http.StatusInternalServerError)
+		return
+	}
+
+	apiKey, err := g.apiKeys.Create(ctx, userID, req.Name, key[:auth.APIKeyDisplayLength], keyHash, scopes)
+	if err != nil {
+		log.Printf("Error creating API key: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	resp := newAPIKeyResponse(apiKey)
+	resp.Key = key
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// handleAPIKey changes the scopes of one of the caller's API keys (PUT) or
+// revokes it (DELETE).
+func (g *Gateway) handleAPIKey(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut && r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, err := strconv.ParseInt(strings.TrimPrefix(r.URL.Path, "/api/keys/"), 10, 64)
+	if err != nil || id <= 0 {
+		http.Error(w, "Invalid API key ID", http.StatusBadRequest)
+		return
+	}
+
+	claims := middleware.ClaimsFromContext(r.Context())
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	if r.Method == http.MethodDelete {
+		if err := g.apiKeys.Revoke(ctx, claims.UserID, id); err != nil {
+			if errors.Is(err, database.ErrAPIKeyNotFound) {
+				http.Error(w, "API key not found", http.StatusNotFound)
+				return
+			}
+			log.Printf("Error revoking API key: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{
+			"message": "API key revoked",
+		})
+		return
+	}
+
+	var req struct {
+		Scopes []string `json:"scopes"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	scopes, err := parseScopes(req.Scopes)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	apiKey, err := g.apiKeys.SetScopes(ctx, claims.UserID, id, scopes)
+	if err != nil {
+		if errors.Is(err, database.ErrAPIKeyNotFound) {
+			http.Error(w, "API key not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("Error updating API key: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(newAPIKeyResponse(apiKey))
+}
@@ -2,11 +2,20 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"html/template"
+	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
@@ -14,26 +23,126 @@ import (
 	"github.com/gorgio/network/pkg/auth"
 	"github.com/gorgio/network/pkg/database"
 	"github.com/gorgio/network/pkg/middleware"
+	"github.com/gorgio/network/pkg/useragent"
 	"github.com/gorgio/network/pkg/validator"
 	"github.com/redis/go-redis/v9"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
 )
 
+const unlockCookieTTL = 10 * time.Minute
+
+// statsStreamHeartbeat is how often an idle click stream sends a comment, so
+// proxies in between do not time the connection out.
+const statsStreamHeartbeat = 15 * time.Second
+
+// Ways to tell visitors apart for unique click counts, picked with
+// VISITOR_IDENTITY.
+const (
+	visitorByIP     = "ip"
+	visitorByIPUA   = "ip_ua"
+	visitorByCookie = "cookie"
+)
+
+const (
+	visitorCookieName = "vid"
+	visitorCookieTTL  = 365 * 24 * time.Hour
+)
+
+var unlockPage = template.Must(template.New("unlock").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+    <meta charset="UTF-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <title>Protected link</title>
+    <link rel="icon" type="image/svg+xml" href="/favicon.svg">
+    <link rel="stylesheet" href="/style.css">
+</head>
+<body>
+    <div class="container">
+        <div class="section">
+            <h2>This link is password protected</h2>
+            <form method="POST" action="/s/{{.ShortCode}}">
+                <div class="form-group">
+                    <input type="password" name="password" placeholder="Enter password" required autofocus />
+                </div>
+                <button type="submit">Continue</button>
+            </form>
+            {{if .Error}}<p class="subtitle">{{.Error}}</p>{{end}}
+        </div>
+    </div>
+</body>
+</html>
+`))
+
 type Gateway struct {
 	urlClient       pb.URLServiceClient
 	analyticsClient pb.AnalyticsServiceClient
 	rateLimiter     *middleware.RateLimiter
+	unlockLimiter   *middleware.RateLimiter
 	userDB          *database.UserDB
+	apiKeys         *database.APIKeyDB
+	refreshTokens   *database.RefreshTokenDB
+	revocations     *auth.Revocations
+	keys            *auth.KeySet
+	visitorIdentity string
+	appendUTM       bool // add the link's campaign tags to its destination
 }
 
-func NewGateway(urlConn, analyticsConn *grpc.ClientConn, rateLimiter *middleware.RateLimiter, userDB *database.UserDB) *Gateway {
+func NewGateway(urlConn, analyticsConn *grpc.ClientConn, rateLimiter, unlockLimiter *middleware.RateLimiter, userDB *database.UserDB, apiKeys *database.APIKeyDB, refreshTokens *database.RefreshTokenDB, revocations *auth.Revocations, keys *auth.KeySet, visitorIdentity string, appendUTM bool) *Gateway {
 	return &Gateway{
 		urlClient:       pb.NewURLServiceClient(urlConn),
 		analyticsClient: pb.NewAnalyticsServiceClient(analyticsConn),
 		rateLimiter:     rateLimiter,
+		unlockLimiter:   unlockLimiter,
 		userDB:          userDB,
+		apiKeys:         apiKeys,
+		refreshTokens:   refreshTokens,
+		revocations:     revocations,
+		keys:            keys,
+		visitorIdentity: visitorIdentity,
+		appendUTM:       appendUTM,
+	}
+}
+
+// tokenResponse is returned wherever a session starts or is refreshed.
+type tokenResponse struct {
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int64  `json:"expires_in"` // seconds until token expires
+	UserID       string `json:"user_id"`
+	Message      string `json:"message,omitempty"`
+}
+
+// startSession issues the access and refresh tokens of a new login.
+func (g *Gateway) startSession(ctx context.Context, userID string) (*tokenResponse, error) {
+	refreshToken, refreshHash, err := auth.NewRefreshToken()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := g.refreshTokens.Create(ctx, userID, refreshHash, time.Now().Add(auth.RefreshTokenTTL)); err != nil {
+		return nil, err
+	}
+
+	isAdmin, err := g.userDB.IsAdmin(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := auth.GenerateToken(userID, isAdmin)
+	if err != nil {
+		return nil, err
 	}
+
+	return &tokenResponse{
+		Token:        token,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int64(auth.AccessTokenTTL.Seconds()),
+		UserID:       userID,
+	}, nil
 }
 
 func securityHeaders(next http.Handler) http.Handler {
@@ -66,7 +175,7 @@ func corsMiddleware(next http.Handler) http.Handler {
 
 		w.Header().Set("Access-Control-Allow-Origin", allowedOrigin)
 		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-API-Key")
 		w.Header().Set("Access-Control-Allow-Credentials", "true")
 
 		if r.Method == "OPTIONS" {
@@ -114,16 +223,179 @@ func (g *Gateway) handleLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	token, err := auth.GenerateToken(username)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	resp, err := g.startSession(ctx, username)
+	if err != nil {
+		log.Printf("Error starting session: %v", err)
+		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// handleRefresh trades a refresh token for a new access token and a new
+// refresh token. The old refresh token stops working; presenting it again
+// ends the whole session.
+func (g *Gateway) handleRefresh(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RefreshToken == "" {
+		http.Error(w, "Refresh token required", http.StatusBadRequest)
+		return
+	}
+
+	refreshToken, refreshHash, err := auth.NewRefreshToken()
+	if err != nil {
+		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	userID, err := g.refreshTokens.Rotate(ctx, auth.HashRefreshToken(req.RefreshToken), refreshHash, time.Now().Add(auth.RefreshTokenTTL))
+	if err != nil {
+		switch {
+		case errors.Is(err, database.ErrRefreshTokenReused):
+			log.Printf("Refresh token reused, session revoked")
+			http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+		case errors.Is(err, database.ErrRefreshTokenInvalid):
+			http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+		default:
+			log.Printf("Error rotating refresh token: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	isAdmin, err := g.userDB.IsAdmin(userID)
+	if err != nil {
+		log.Printf("Error loading user %s: %v", userID, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	token, err := auth.GenerateToken(userID, isAdmin)
 	if err != nil {
 		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
 		return
 	}
 
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&tokenResponse{
+		Token:        token,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int64(auth.AccessTokenTTL.Seconds()),
+		UserID:       userID,
+	})
+}
+
+// handleLogout ends the caller's session. It takes the access token in the
+// Authorization header, the refresh token in the body, or both, so a client
+// whose access token already expired can still log out.
+func (g *Gateway) handleLogout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	loggedOut := false
+
+	if claims := middleware.ClaimsFromContext(r.Context()); claims != nil && claims.Token != nil {
+		if err := g.revocations.RevokeToken(ctx, claims.Token); err != nil {
+			log.Printf("Error revoking access token: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		loggedOut = true
+	}
+
+	if req.RefreshToken != "" {
+		_, err := g.refreshTokens.RevokeSession(ctx, auth.HashRefreshToken(req.RefreshToken))
+		switch {
+		case err == nil:
+			loggedOut = true
+		case !errors.Is(err, database.ErrRefreshTokenInvalid):
+			log.Printf("Error revoking session: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if !loggedOut {
+		http.Error(w, "Valid access or refresh token required", http.StatusUnauthorized)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Logged out",
+	})
+}
+
+// handleJWKS publishes the public keys tokens are signed with, so other
+// services can verify them without calling the gateway.
+func (g *Gateway) handleJWKS(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	json.NewEncoder(w).Encode(g.keys.JWKS())
+}
+
+// handleLogoutAll ends every session of the caller, on all devices.
+func (g *Gateway) handleLogoutAll(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	claims := middleware.ClaimsFromContext(r.Context())
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	if err := g.refreshTokens.RevokeUser(ctx, claims.UserID); err != nil {
+		log.Printf("Error revoking sessions of %s: %v", claims.UserID, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	if err := g.revocations.RevokeUser(ctx, claims.UserID, time.Now()); err != nil {
+		log.Printf("Error revoking access tokens of %s: %v", claims.UserID, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]string{
-		"token":   token,
-		"user_id": username,
+		"message": "Logged out of all sessions",
 	})
 }
 
@@ -192,18 +464,19 @@ func (g *Gateway) handleRegister(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	token, err := auth.GenerateToken(username)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	resp, err := g.startSession(ctx, username)
 	if err != nil {
+		log.Printf("Error starting session: %v", err)
 		http.Error(w, "User created but failed to generate token", http.StatusInternalServerError)
 		return
 	}
+	resp.Message = "User created successfully"
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{
-		"token":   token,
-		"user_id": username,
-		"message": "User created successfully",
-	})
+	json.NewEncoder(w).Encode(resp)
 }
 
 func (g *Gateway) handleCreateShortURL(w http.ResponseWriter, r *http.Request) {
@@ -212,23 +485,18 @@ func (g *Gateway) handleCreateShortURL(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Extract JWT token
-	authHeader := r.Header.Get("Authorization")
-	if authHeader == "" {
-		http.Error(w, "Authorization header required", http.StatusUnauthorized)
-		return
-	}
-
-	tokenString := strings.TrimPrefix(authHeader, "Bearer ")
-	claims, err := auth.ValidateToken(tokenString)
-	if err != nil {
-		http.Error(w, "Invalid token", http.StatusUnauthorized)
-		return
-	}
+	claims := middleware.ClaimsFromContext(r.Context())
 
 	var req struct {
-		URL         string `json:"url"`
-		CustomAlias string `json:"custom_alias,omitempty"`
+		URL            string `json:"url"`
+		CustomAlias    string `json:"custom_alias,omitempty"`
+		ExpiresAt      int64  `json:"expires_at,omitempty"`
+		MaxClicks      int64  `json:"max_clicks,omitempty"`
+		Password       string `json:"password,omitempty"`
+		RedirectStatus int32  `json:"redirect_status,omitempty"`
+		Campaign       string `json:"campaign,omitempty"`
+		Source         string `json:"source,omitempty"`
+		Medium         string `json:"medium,omitempty"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -238,19 +506,33 @@ func (g *Gateway) handleCreateShortURL(w http.ResponseWriter, r *http.Request) {
 
 	req.URL = validator.SanitizeInput(req.URL)
 	req.CustomAlias = validator.SanitizeInput(req.CustomAlias)
+	req.Campaign = validator.SanitizeInput(req.Campaign)
+	req.Source = validator.SanitizeInput(req.Source)
+	req.Medium = validator.SanitizeInput(req.Medium)
 
-
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
 	defer cancel()
 
 	resp, err := g.urlClient.CreateShortURL(ctx, &pb.CreateShortURLRequest{
-		OriginalUrl: req.URL,
-		UserId:      claims.UserID,
-		CustomAlias: req.CustomAlias,
+		OriginalUrl:    req.URL,
+		UserId:         claims.UserID,
+		CustomAlias:    req.CustomAlias,
+		ExpiresAt:      req.ExpiresAt,
+		MaxClicks:      req.MaxClicks,
+		Password:       req.Password,
+		RedirectStatus: req.RedirectStatus,
+		Campaign:       req.Campaign,
+		Source:         req.Source,
+		Medium:         req.Medium,
 	})
 
 	if err != nil {
 		log.Printf("Error creating short URL: %v", err)
+		switch status.Code(err) {
+		case codes.AlreadyExists, codes.InvalidArgument, codes.Unauthenticated:
+			http.Error(w, status.Convert(err).Message(), httpStatusFromGRPC(err))
+			return
+		}
 		http.Error(w, fmt.Sprintf("Failed to create short URL: %v", err), http.StatusInternalServerError)
 		return
 	}
@@ -259,6 +541,110 @@ func (g *Gateway) handleCreateShortURL(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(resp)
 }
 
+// handleBatchCreateShortURL accepts either a JSON body
+// {"items": [{"url": ..., "custom_alias": ...}]} or, with Content-Type
+// text/csv, rows of url,custom_alias with an optional header row.
+func (g *Gateway) handleBatchCreateShortURL(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	claims := middleware.ClaimsFromContext(r.Context())
+
+	var items []*pb.CreateShortURLRequest
+	var err error
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "text/csv") {
+		items, err = parseBatchCSV(r.Body)
+	} else {
+		items, err = parseBatchJSON(r.Body)
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 60*time.Second)
+	defer cancel()
+
+	resp, err := g.urlClient.BatchCreateShortURL(ctx, &pb.BatchCreateShortURLRequest{
+		UserId: claims.UserID,
+		Items:  items,
+	})
+
+	if err != nil {
+		log.Printf("Error creating short URL batch: %v", err)
+		http.Error(w, status.Convert(err).Message(), httpStatusFromGRPC(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func parseBatchJSON(body io.Reader) ([]*pb.CreateShortURLRequest, error) {
+	var req struct {
+		Items []struct {
+			URL            string `json:"url"`
+			CustomAlias    string `json:"custom_alias,omitempty"`
+			ExpiresAt      int64  `json:"expires_at,omitempty"`
+			MaxClicks      int64  `json:"max_clicks,omitempty"`
+			RedirectStatus int32  `json:"redirect_status,omitempty"`
+			Campaign       string `json:"campaign,omitempty"`
+			Source         string `json:"source,omitempty"`
+			Medium         string `json:"medium,omitempty"`
+		} `json:"items"`
+	}
+
+	if err := json.NewDecoder(body).Decode(&req); err != nil {
+		return nil, err
+	}
+
+	items := make([]*pb.CreateShortURLRequest, 0, len(req.Items))
+	for _, item := range req.Items {
+		items = append(items, &pb.CreateShortURLRequest{
+			OriginalUrl:    validator.SanitizeInput(item.URL),
+			CustomAlias:    validator.SanitizeInput(item.CustomAlias),
+			ExpiresAt:      item.ExpiresAt,
+			MaxClicks:      item.MaxClicks,
+			RedirectStatus: item.RedirectStatus,
+			Campaign:       validator.SanitizeInput(item.Campaign),
+			Source:         validator.SanitizeInput(item.Source),
+			Medium:         validator.SanitizeInput(item.Medium),
+		})
+	}
+
+	return items, nil
+}
+
+func parseBatchCSV(body io.Reader) ([]*pb.CreateShortURLRequest, error) {
+	reader := csv.NewReader(body)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(records) > 0 && len(records[0]) > 0 && strings.EqualFold(strings.TrimSpace(records[0][0]), "url") {
+		records = records[1:]
+	}
+
+	items := make([]*pb.CreateShortURLRequest, 0, len(records))
+	for _, record := range records {
+		item := &pb.CreateShortURLRequest{
+			OriginalUrl: validator.SanitizeInput(record[0]),
+		}
+		if len(record) > 1 {
+			item.CustomAlias = validator.SanitizeInput(record[1])
+		}
+		items = append(items, item)
+	}
+
+	return items, nil
+}
+
 func (g *Gateway) handleRedirect(w http.ResponseWriter, r *http.Request) {
 	shortCode := strings.TrimPrefix(r.URL.Path, "/s/")
 	if shortCode == "" {
@@ -271,11 +657,23 @@ func (g *Gateway) handleRedirect(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if r.Method == http.MethodPost {
+		g.handleUnlock(w, r, shortCode)
+		return
+	}
+
+	// Bots are told apart before the lookup, which uses up a click of
+	// click-capped links. They are counted apart and never get a visitor
+	// cookie.
+	isBot := isBotRequest(r)
+
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
 	urlResp, err := g.urlClient.GetOriginalURL(ctx, &pb.GetOriginalURLRequest{
 		ShortCode: shortCode,
+		Unlocked:  hasUnlockCookie(r, shortCode),
+		IsBot:     isBot,
 	})
 
 	if err != nil {
@@ -289,100 +687,572 @@ func (g *Gateway) handleRedirect(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if urlResp.Expired {
+		http.Error(w, "Short URL has expired", http.StatusGone)
+		return
+	}
+
+	if urlResp.PasswordProtected && urlResp.OriginalUrl == "" {
+		renderUnlockPage(w, shortCode, "", http.StatusOK)
+		return
+	}
+
+	if urlResp.WithheldFromBot {
+		http.Error(w, "This link can only be opened in a browser", http.StatusForbidden)
+		return
+	}
+
+	visitorID := ""
+	if !isBot {
+		visitorID = g.visitorID(w, r)
+	}
+
 	go func() {
 		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 		defer cancel()
 
 		_, err := g.analyticsClient.RecordClick(ctx, &pb.RecordClickRequest{
 			ShortCode: shortCode,
-			IpAddress: getClientIP(r),
+			IpAddress: middleware.ClientIP(r),
 			UserAgent: r.UserAgent(),
 			Referer:   r.Referer(),
+			VisitorId: visitorID,
+			IsBot:     isBot,
+			OwnerId:   urlResp.UserId,
+			Campaign:  urlResp.Campaign,
+			Source:    urlResp.Source,
+			Medium:    urlResp.Medium,
 		})
 		if err != nil {
 			log.Printf("Failed to record click: %v", err)
 		}
 	}()
 
-	http.Redirect(w, r, urlResp.OriginalUrl, http.StatusMovedPermanently)
-}
+	redirectStatus := int(urlResp.RedirectStatus)
+	if validator.ValidateRedirectStatus(urlResp.RedirectStatus) != nil {
+		redirectStatus = http.StatusMovedPermanently
+	}
 
-func (g *Gateway) handleGetUserURLs(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
+	destination := urlResp.OriginalUrl
+	if g.appendUTM {
+		destination = appendUTMParams(destination, urlResp.Campaign, urlResp.Source, urlResp.Medium)
 	}
 
-	// Extract JWT token
-	authHeader := r.Header.Get("Authorization")
-	if authHeader == "" {
-		http.Error(w, "Authorization header required", http.StatusUnauthorized)
-		return
+	setsCookie := w.Header().Get("Set-Cookie") != ""
+	w.Header().Set("Cache-Control", redirectCacheControl(urlResp, redirectStatus, setsCookie, time.Now()))
+	http.Redirect(w, r, destination, redirectStatus)
+}
+
+// appendUTMParams adds utm_campaign, utm_source and utm_medium to destination
+// for the tags the link has. Parameters the destination already carries are
+// left alone, and a destination that does not parse is returned unchanged.
+func appendUTMParams(destination, campaign, source, medium string) string {
+	if campaign == "" && source == "" && medium == "" {
+		return destination
 	}
 
-	tokenString := strings.TrimPrefix(authHeader, "Bearer ")
-	claims, err := auth.ValidateToken(tokenString)
+	u, err := url.Parse(destination)
 	if err != nil {
-		http.Error(w, "Invalid token", http.StatusUnauthorized)
-		return
+		return destination
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
+	query := u.Query()
+	for _, param := range []struct{ name, value string }{
+		{"utm_campaign", campaign},
+		{"utm_source", source},
+		{"utm_medium", medium},
+	} {
+		if param.value != "" && !query.Has(param.name) {
+			query.Set(param.name, param.value)
+		}
+	}
 
-	resp, err := g.urlClient.GetUserURLs(ctx, &pb.GetUserURLsRequest{
-		UserId: claims.UserID,
-	})
+	u.RawQuery = query.Encode()
+	return u.String()
+}
 
-	if err != nil {
-		log.Printf("Error getting user URLs: %v", err)
-		http.Error(w, "Failed to get URLs", http.StatusInternalServerError)
-		return
+// redirectCacheControl keeps permanent redirects cacheable for a bounded time
+// instead of forever, and stops browsers from caching temporary ones so every
+// visit reaches the gateway. Redirects of password-protected and click-capped
+// links are never cached, since a cached one would skip the password or the
+// count, and none is cached past its link's expiry. Responses that set a
+// visitor cookie stay out of shared caches.
+func redirectCacheControl(link *pb.GetOriginalURLResponse, redirectStatus int, setsCookie bool, now time.Time) string {
+	if link.PasswordProtected || link.ClickCapped {
+		return "no-store"
+	}
+	if redirectStatus != http.StatusMovedPermanently && redirectStatus != http.StatusPermanentRedirect {
+		return "no-store"
 	}
 
-	if resp.Urls == nil {
-		resp.Urls = []*pb.URLInfo{}
+	maxAge := int64(86400)
+	if link.ExpiresAt != 0 {
+		maxAge = min(maxAge, link.ExpiresAt-now.Unix())
+		if maxAge <= 0 {
+			return "no-store"
+		}
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(resp)
+	if setsCookie {
+		return fmt.Sprintf("private, max-age=%d", maxAge)
+	}
+	return fmt.Sprintf("public, max-age=%d", maxAge)
 }
 
-func (g *Gateway) handleGetStats(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
-	}
+// handleUnlock checks the password posted from the unlock page. On success it
+// sets a short-lived cookie scoped to the link and sends the visitor back to
+// /s/<code>, which then redirects as usual.
+func (g *Gateway) handleUnlock(w http.ResponseWriter, r *http.Request, shortCode string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
 
-	shortCode := r.URL.Query().Get("code")
-	if shortCode == "" {
-		http.Error(w, "Short code required", http.StatusBadRequest)
+	exceeded, err := g.unlockLimiter.Exceeded(ctx, shortCode)
+	if err != nil {
+		log.Printf("Error checking unlock rate limit: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
 
-	if err := validator.ValidateShortCode(shortCode); err != nil {
-		http.Error(w, "Invalid short code", http.StatusBadRequest)
+	if exceeded {
+		renderUnlockPage(w, shortCode, "Too many attempts, try again later", http.StatusTooManyRequests)
 		return
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-
-	resp, err := g.analyticsClient.GetClickStats(ctx, &pb.GetClickStatsRequest{
+	resp, err := g.urlClient.VerifyURLPassword(ctx, &pb.VerifyURLPasswordRequest{
 		ShortCode: shortCode,
+		Password:  r.PostFormValue("password"),
 	})
 
 	if err != nil {
-		log.Printf("Error getting stats: %v", err)
-		http.Error(w, "Failed to get stats", http.StatusInternalServerError)
+		log.Printf("Error verifying link password: %v", err)
+		http.Error(w, status.Convert(err).Message(), httpStatusFromGRPC(err))
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(resp)
-}
+	if !resp.Valid {
+		if _, err := g.unlockLimiter.Hit(ctx, shortCode); err != nil {
+			log.Printf("Error recording failed unlock: %v", err)
+		}
+		renderUnlockPage(w, shortCode, "Incorrect password", http.StatusUnauthorized)
+		return
+	}
 
-func (g *Gateway) handleGetTopURLs(w http.ResponseWriter, r *http.Request) {
+	token, err := auth.GenerateLinkToken(shortCode, unlockCookieTTL)
+	if err != nil {
+		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     unlockCookieName(shortCode),
+		Value:    token,
+		Path:     "/s/" + shortCode,
+		MaxAge:   int(unlockCookieTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https",
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	http.Redirect(w, r, "/s/"+shortCode, http.StatusSeeOther)
+}
+
+func unlockCookieName(shortCode string) string {
+	return "unlock_" + shortCode
+}
+
+func hasUnlockCookie(r *http.Request, shortCode string) bool {
+	cookie, err := r.Cookie(unlockCookieName(shortCode))
+	if err != nil {
+		return false
+	}
+	return auth.ValidateLinkToken(cookie.Value, shortCode) == nil
+}
+
+// visitorID identifies the visitor for unique click counts. In cookie mode a
+// first visit gets a random ID cookie shared by every short link.
+func (g *Gateway) visitorID(w http.ResponseWriter, r *http.Request) string {
+	switch g.visitorIdentity {
+	case visitorByIPUA:
+		sum := sha256.Sum256([]byte(middleware.ClientIP(r) + "\n" + r.UserAgent()))
+		return hex.EncodeToString(sum[:16])
+	case visitorByCookie:
+		if cookie, err := r.Cookie(visitorCookieName); err == nil && validVisitorID(cookie.Value) {
+			return cookie.Value
+		}
+
+		buf := make([]byte, 16)
+		if _, err := rand.Read(buf); err != nil {
+			log.Printf("Failed to generate visitor ID: %v", err)
+			return middleware.ClientIP(r)
+		}
+		id := hex.EncodeToString(buf)
+
+		http.SetCookie(w, &http.Cookie{
+			Name:     visitorCookieName,
+			Value:    id,
+			Path:     "/s/",
+			MaxAge:   int(visitorCookieTTL.Seconds()),
+			HttpOnly: true,
+			Secure:   r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https",
+			SameSite: http.SameSiteLaxMode,
+		})
+		return id
+	default:
+		return middleware.ClientIP(r)
+	}
+}
+
+// isBotRequest flags hits that are almost certainly not a person following
+// the link: known crawler and unfurler user agents, HEAD requests used to
+// probe links, and clients that send no Accept header, which every browser
+// does.
+func isBotRequest(r *http.Request) bool {
+	if r.Method == http.MethodHead {
+		return true
+	}
+	if r.Header.Get("Accept") == "" || r.UserAgent() == "" {
+		return true
+	}
+	return useragent.IsBot(r.UserAgent())
+}
+
+func validVisitorID(id string) bool {
+	if len(id) != 32 {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
+
+func renderUnlockPage(w http.ResponseWriter, shortCode, message string, statusCode int) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(statusCode)
+
+	err := unlockPage.Execute(w, struct {
+		ShortCode string
+		Error     string
+	}{shortCode, message})
+	if err != nil {
+		log.Printf("Failed to render unlock page: %v", err)
+	}
+}
+
+func (g *Gateway) handleGetUserURLs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	claims := middleware.ClaimsFromContext(r.Context())
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	query := r.URL.Query()
+
+	pageSize := 0
+	if value := query.Get("page_size"); value != "" {
+		var err error
+		pageSize, err = strconv.Atoi(value)
+		if err != nil || pageSize < 0 {
+			http.Error(w, "Invalid page_size", http.StatusBadRequest)
+			return
+		}
+	}
+
+	resp, err := g.urlClient.GetUserURLs(ctx, &pb.GetUserURLsRequest{
+		UserId:    claims.UserID,
+		PageSize:  int32(pageSize),
+		PageToken: query.Get("page_token"),
+		Sort:      query.Get("sort"),
+		Query:     validator.SanitizeInput(query.Get("q")),
+	})
+
+	if err != nil {
+		log.Printf("Error getting user URLs: %v", err)
+		if status.Code(err) == codes.InvalidArgument {
+			http.Error(w, status.Convert(err).Message(), http.StatusBadRequest)
+			return
+		}
+		http.Error(w, "Failed to get URLs", http.StatusInternalServerError)
+		return
+	}
+
+	if resp.Urls == nil {
+		resp.Urls = []*pb.URLInfo{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (g *Gateway) handleURL(w http.ResponseWriter, r *http.Request) {
+	if shortCode, ok := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/api/urls/"), "/stats-token"); ok {
+		g.handleStatsToken(w, r, shortCode)
+		return
+	}
+
+	if r.Method != http.MethodPut && r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	shortCode := strings.TrimPrefix(r.URL.Path, "/api/urls/")
+	if err := validator.ValidateShortCode(shortCode); err != nil {
+		http.Error(w, "Invalid short code", http.StatusBadRequest)
+		return
+	}
+
+	claims := middleware.ClaimsFromContext(r.Context())
+
+	if r.Method == http.MethodDelete {
+		g.handleDeleteShortURL(w, r, shortCode, claims.UserID)
+		return
+	}
+
+	g.handleUpdateShortURL(w, r, shortCode, claims.UserID)
+}
+
+// handleStatsToken shares a link's analytics read-only (POST), which issues a
+// new stats token and invalidates the previous one, or stops sharing them
+// (DELETE).
+func (g *Gateway) handleStatsToken(w http.ResponseWriter, r *http.Request, shortCode string) {
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := validator.ValidateShortCode(shortCode); err != nil {
+		http.Error(w, "Invalid short code", http.StatusBadRequest)
+		return
+	}
+
+	claims := middleware.ClaimsFromContext(r.Context())
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	resp, err := g.urlClient.SetStatsSharing(ctx, &pb.SetStatsSharingRequest{
+		ShortCode: shortCode,
+		UserId:    claims.UserID,
+		Enabled:   r.Method == http.MethodPost,
+	})
+
+	if err != nil {
+		log.Printf("Error setting stats sharing: %v", err)
+		http.Error(w, status.Convert(err).Message(), httpStatusFromGRPC(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method == http.MethodDelete {
+		json.NewEncoder(w).Encode(map[string]string{
+			"message": "Stats sharing disabled",
+		})
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{
+		"stats_token": resp.StatsToken,
+		"stats_url":   fmt.Sprintf("/api/stats?code=%s&token=%s", shortCode, resp.StatsToken),
+	})
+}
+
+func (g *Gateway) handleUpdateShortURL(w http.ResponseWriter, r *http.Request, shortCode, userID string) {
+	var req struct {
+		URL            string `json:"url,omitempty"`
+		CustomAlias    string `json:"custom_alias,omitempty"`
+		RedirectStatus int32  `json:"redirect_status,omitempty"`
+		// Left out, these keep their value; 0 or "" clears them.
+		ExpiresAt *int64  `json:"expires_at,omitempty"`
+		MaxClicks *int64  `json:"max_clicks,omitempty"`
+		Campaign  *string `json:"campaign,omitempty"`
+		Source    *string `json:"source,omitempty"`
+		Medium    *string `json:"medium,omitempty"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	req.URL = validator.SanitizeInput(req.URL)
+	req.CustomAlias = validator.SanitizeInput(req.CustomAlias)
+	for _, tag := range []*string{req.Campaign, req.Source, req.Medium} {
+		if tag != nil {
+			*tag = validator.SanitizeInput(*tag)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	resp, err := g.urlClient.UpdateShortURL(ctx, &pb.UpdateShortURLRequest{
+		ShortCode:      shortCode,
+		UserId:         userID,
+		OriginalUrl:    req.URL,
+		CustomAlias:    req.CustomAlias,
+		RedirectStatus: req.RedirectStatus,
+		ExpiresAt:      req.ExpiresAt,
+		MaxClicks:      req.MaxClicks,
+		Campaign:       req.Campaign,
+		Source:         req.Source,
+		Medium:         req.Medium,
+	})
+
+	if err != nil {
+		log.Printf("Error updating short URL: %v", err)
+		http.Error(w, status.Convert(err).Message(), httpStatusFromGRPC(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp.Url)
+}
+
+func (g *Gateway) handleDeleteShortURL(w http.ResponseWriter, r *http.Request, shortCode, userID string) {
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	resp, err := g.urlClient.DeleteShortURL(ctx, &pb.DeleteShortURLRequest{
+		ShortCode: shortCode,
+		UserId:    userID,
+	})
+
+	if err != nil {
+		log.Printf("Error deleting short URL: %v", err)
+		http.Error(w, status.Convert(err).Message(), httpStatusFromGRPC(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (g *Gateway) handleGetStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	shortCode := r.URL.Query().Get("code")
+	if shortCode == "" {
+		http.Error(w, "Short code required", http.StatusBadRequest)
+		return
+	}
+
+	if err := validator.ValidateShortCode(shortCode); err != nil {
+		http.Error(w, "Invalid short code", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	query := r.URL.Query()
+	resp, err := g.analyticsClient.GetClickStats(ctx, &pb.GetClickStatsRequest{
+		ShortCode:   shortCode,
+		From:        query.Get("from"),
+		To:          query.Get("to"),
+		Granularity: query.Get("granularity"),
+		StatsToken:  query.Get("token"),
+	})
+
+	if err != nil {
+		log.Printf("Error getting stats: %v", err)
+		writeStatsError(w, err, "Failed to get stats")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// handleStatsStream relays a link's clicks to its owner as Server-Sent Events
+// until the client disconnects. Each click is a "click" event whose data is
+// the JSON ClickEvent.
+func (g *Gateway) handleStatsStream(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	shortCode := r.URL.Query().Get("code")
+	if err := validator.ValidateShortCode(shortCode); err != nil {
+		http.Error(w, "Invalid short code", http.StatusBadRequest)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	// The stream lives as long as the client connection.
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	stream, err := g.analyticsClient.StreamClicks(ctx, &pb.StreamClicksRequest{
+		ShortCode: shortCode,
+	})
+	if err != nil {
+		log.Printf("Error streaming clicks: %v", err)
+		http.Error(w, "Failed to stream clicks", http.StatusInternalServerError)
+		return
+	}
+
+	events := make(chan *pb.ClickEvent)
+	streamErr := make(chan error, 1)
+	go func() {
+		for {
+			event, err := stream.Recv()
+			if err != nil {
+				streamErr <- err
+				return
+			}
+			select {
+			case events <- event:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	// Stops nginx from buffering the events.
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(statsStreamHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case err := <-streamErr:
+			log.Printf("Click stream for %s ended: %v", shortCode, err)
+			return
+		case event := <-events:
+			data, err := json.Marshal(event)
+			if err != nil {
+				log.Printf("Failed to encode click event: %v", err)
+				continue
+			}
+			fmt.Fprintf(w, "event: click\ndata: %s\n\n", data)
+			flusher.Flush()
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": heartbeat\n\n")
+			flusher.Flush()
+		}
+	}
+}
+
+func (g *Gateway) handleGetTopURLs(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
@@ -395,16 +1265,35 @@ func (g *Gateway) handleGetTopURLs(w http.ResponseWriter, r *http.Request) {
 
 	limit := 100
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	query := r.URL.Query()
+
+	days := 0
+	if value := query.Get("days"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 {
+			http.Error(w, "Invalid days", http.StatusBadRequest)
+			return
+		}
+		days = parsed
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
 	defer cancel()
 
 	resp, err := g.analyticsClient.GetTopURLs(ctx, &pb.GetTopURLsRequest{
 		Period: period,
 		Limit:  int32(limit),
+		From:   query.Get("from"),
+		To:     query.Get("to"),
+		Days:   int32(days),
 	})
 
 	if err != nil {
 		log.Printf("Error getting top URLs: %v", err)
+		if status.Code(err) == codes.InvalidArgument {
+			http.Error(w, status.Convert(err).Message(), http.StatusBadRequest)
+			return
+		}
 		http.Error(w, "Failed to get top URLs", http.StatusInternalServerError)
 		return
 	}
@@ -432,17 +1321,134 @@ func (g *Gateway) handleGetTopReferers(w http.ResponseWriter, r *http.Request) {
 
 	limit := 100
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
 	defer cancel()
 
 	resp, err := g.analyticsClient.GetTopReferers(ctx, &pb.GetTopReferersRequest{
-		ShortCode: shortCode,
-		Limit:     int32(limit),
+		ShortCode:  shortCode,
+		Limit:      int32(limit),
+		GroupBy:    r.URL.Query().Get("group_by"),
+		StatsToken: r.URL.Query().Get("token"),
 	})
 
 	if err != nil {
 		log.Printf("Error getting top referers: %v", err)
-		http.Error(w, "Failed to get top referers", http.StatusInternalServerError)
+		writeStatsError(w, err, "Failed to get top referers")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (g *Gateway) handleGetBreakdown(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	shortCode := r.URL.Query().Get("code")
+	if shortCode == "" {
+		http.Error(w, "Short code required", http.StatusBadRequest)
+		return
+	}
+
+	if err := validator.ValidateShortCode(shortCode); err != nil {
+		http.Error(w, "Invalid short code", http.StatusBadRequest)
+		return
+	}
+
+	dimension := r.URL.Query().Get("dimension")
+	if dimension == "" {
+		http.Error(w, "Dimension required", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	resp, err := g.analyticsClient.GetBreakdown(ctx, &pb.GetBreakdownRequest{
+		ShortCode:  shortCode,
+		Dimension:  dimension,
+		StatsToken: r.URL.Query().Get("token"),
+	})
+
+	if err != nil {
+		log.Printf("Error getting breakdown: %v", err)
+		writeStatsError(w, err, "Failed to get breakdown")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (g *Gateway) handleGetGeoBreakdown(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	shortCode := r.URL.Query().Get("code")
+	if shortCode == "" {
+		http.Error(w, "Short code required", http.StatusBadRequest)
+		return
+	}
+
+	if err := validator.ValidateShortCode(shortCode); err != nil {
+		http.Error(w, "Invalid short code", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	resp, err := g.analyticsClient.GetGeoBreakdown(ctx, &pb.GetGeoBreakdownRequest{
+		ShortCode:  shortCode,
+		Level:      r.URL.Query().Get("level"),
+		StatsToken: r.URL.Query().Get("token"),
+	})
+
+	if err != nil {
+		log.Printf("Error getting geo breakdown: %v", err)
+		writeStatsError(w, err, "Failed to get geo breakdown")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// handleGetCampaignStats reports on one of the caller's own campaigns.
+func (g *Gateway) handleGetCampaignStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	claims := middleware.ClaimsFromContext(r.Context())
+
+	campaign := validator.SanitizeInput(r.URL.Query().Get("name"))
+	if campaign == "" {
+		http.Error(w, "Campaign name required", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	resp, err := g.analyticsClient.GetCampaignStats(ctx, &pb.GetCampaignStatsRequest{
+		UserId:   claims.UserID,
+		Campaign: campaign,
+	})
+
+	if err != nil {
+		log.Printf("Error getting campaign stats: %v", err)
+		if status.Code(err) == codes.InvalidArgument {
+			http.Error(w, status.Convert(err).Message(), http.StatusBadRequest)
+			return
+		}
+		http.Error(w, "Failed to get campaign stats", http.StatusInternalServerError)
 		return
 	}
 
@@ -469,17 +1475,18 @@ func (g *Gateway) handleGetHourlyDistribution(w http.ResponseWriter, r *http.Req
 
 	date := r.URL.Query().Get("date")
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
 	defer cancel()
 
 	resp, err := g.analyticsClient.GetHourlyDistribution(ctx, &pb.GetHourlyDistributionRequest{
-		ShortCode: shortCode,
-		Date:      date,
+		ShortCode:  shortCode,
+		Date:       date,
+		StatsToken: r.URL.Query().Get("token"),
 	})
 
 	if err != nil {
 		log.Printf("Error getting hourly distribution: %v", err)
-		http.Error(w, "Failed to get hourly distribution", http.StatusInternalServerError)
+		writeStatsError(w, err, "Failed to get hourly distribution")
 		return
 	}
 
@@ -487,31 +1494,97 @@ func (g *Gateway) handleGetHourlyDistribution(w http.ResponseWriter, r *http.Req
 	json.NewEncoder(w).Encode(resp)
 }
 
-func getClientIP(r *http.Request) string {
-	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
-		if idx := strings.Index(xff, ","); idx != -1 {
-			return strings.TrimSpace(xff[:idx])
-		}
-		return strings.TrimSpace(xff)
+// ownsShortCode is the owner check of the routes that need one.
+func (g *Gateway) ownsShortCode(ctx context.Context, shortCode, userID string) error {
+	_, err := g.urlClient.GetShortURL(ctx, &pb.GetShortURLRequest{
+		ShortCode: shortCode,
+		UserId:    userID,
+	})
+
+	switch status.Code(err) {
+	case codes.OK:
+		return nil
+	case codes.NotFound:
+		return middleware.ErrCodeNotFound
+	case codes.PermissionDenied:
+		return middleware.ErrNotOwner
+	default:
+		return err
 	}
-	if xri := r.Header.Get("X-Real-IP"); xri != "" {
-		return xri
+}
+
+// writeStatsError reports a failed analytics read. Refusals and bad input are
+// passed on to the client; anything else is reported as message.
+func writeStatsError(w http.ResponseWriter, err error, message string) {
+	switch status.Code(err) {
+	case codes.InvalidArgument, codes.Unauthenticated, codes.PermissionDenied, codes.NotFound:
+		http.Error(w, status.Convert(err).Message(), httpStatusFromGRPC(err))
+	default:
+		http.Error(w, message, http.StatusInternalServerError)
 	}
-	ip := r.RemoteAddr
-	if idx := strings.LastIndex(ip, ":"); idx != -1 {
-		ip = ip[:idx]
+}
+
+// httpStatusFromGRPC maps backend gRPC status codes onto HTTP responses.
+func httpStatusFromGRPC(err error) int {
+	switch status.Code(err) {
+	case codes.InvalidArgument:
+		return http.StatusBadRequest
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.AlreadyExists:
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// pruneRefreshTokens deletes expired refresh tokens once a day.
+func pruneRefreshTokens(ctx context.Context, refreshTokens *database.RefreshTokenDB) {
+	ticker := time.NewTicker(24 * time.Hour)
+	defer ticker.Stop()
+
+	for {
+		count, err := refreshTokens.PruneExpired(ctx, time.Now())
+		if err != nil {
+			log.Printf("Failed to prune refresh tokens: %v", err)
+		} else if count > 0 {
+			log.Printf("Pruned %d expired refresh tokens", count)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
 	}
-	return ip
 }
 
 func main() {
-	urlConn, err := grpc.Dial("urlservice:8081", grpc.WithTransportCredentials(insecure.NewCredentials()))
+	keysDir := os.Getenv("JWT_KEYS_DIR")
+	if keysDir == "" {
+		keysDir = "/app/keys"
+	}
+
+	keys, err := auth.LoadKeySet(keysDir, os.Getenv("JWT_SIGNING_KEY"))
+	if err != nil {
+		log.Fatalf("Failed to load JWT keys: %v", err)
+	}
+	auth.UseKeySet(keys)
+	log.Printf("Loaded %d JWT keys", len(keys.Keys()))
+
+	dialOptions := append([]grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())}, middleware.ForwardClaims()...)
+
+	urlConn, err := grpc.Dial("urlservice:8081", dialOptions...)
 	if err != nil {
 		log.Fatalf("Failed to connect to URL service: %v", err)
 	}
 	defer urlConn.Close()
 
-	analyticsConn, err := grpc.Dial("analytics:8082", grpc.WithTransportCredentials(insecure.NewCredentials()))
+	analyticsConn, err := grpc.Dial("analytics:8082", dialOptions...)
 	if err != nil {
 		log.Fatalf("Failed to connect to Analytics service: %v", err)
 	}
@@ -529,6 +1602,18 @@ func main() {
 	defer userDB.Close()
 	log.Println("Connected to PostgreSQL")
 
+	refreshTokens, err := database.NewRefreshTokenDB(databaseURL)
+	if err != nil {
+		log.Fatalf("Failed to connect to database: %v", err)
+	}
+	defer refreshTokens.Close()
+
+	apiKeys, err := database.NewAPIKeyDB(databaseURL)
+	if err != nil {
+		log.Fatalf("Failed to connect to database: %v", err)
+	}
+	defer apiKeys.Close()
+
 	redisClient := redis.NewClient(&redis.Options{
 		Addr: "redis:6379",
 	})
@@ -540,27 +1625,88 @@ func main() {
 		log.Println("Connected to Redis")
 	}
 
-	rateLimiter := middleware.NewRateLimiter(redisClient, 100, time.Minute)
+	revocations := auth.NewRevocations(redisClient)
+	auth.UseRevocations(revocations)
+
+	go pruneRefreshTokens(ctx, refreshTokens)
+
+	if err := middleware.UseTrustedProxies(os.Getenv("TRUSTED_PROXIES")); err != nil {
+		log.Fatalf("Invalid TRUSTED_PROXIES: %v", err)
+	}
+
+	rateLimiter := middleware.NewRateLimiter(redisClient, "ip", 100, time.Minute)
+	unlockLimiter := middleware.NewRateLimiter(redisClient, "unlock", 5, 15*time.Minute)
 
-	gateway := NewGateway(urlConn, analyticsConn, rateLimiter, userDB)
+	apiKeyRateLimit := 60
+	if value := os.Getenv("API_KEY_RATE_LIMIT"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 {
+			log.Printf("Ignoring API_KEY_RATE_LIMIT=%s: must be a positive number", value)
+		} else {
+			apiKeyRateLimit = parsed
+		}
+	}
+	apiKeyLimiter := middleware.NewRateLimiter(redisClient, "apikey", apiKeyRateLimit, time.Minute)
+
+	visitorIdentity := visitorByIP
+	if value := os.Getenv("VISITOR_IDENTITY"); value != "" {
+		switch value {
+		case visitorByIP, visitorByIPUA, visitorByCookie:
+			visitorIdentity = value
+		default:
+			log.Printf("Ignoring VISITOR_IDENTITY=%s: must be ip, ip_ua or cookie", value)
+		}
+	}
+
+	appendUTM := false
+	if value := os.Getenv("APPEND_UTM_PARAMS"); value != "" {
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			log.Printf("Ignoring APPEND_UTM_PARAMS=%s: must be true or false", value)
+		} else {
+			appendUTM = parsed
+		}
+	}
+
+	gateway := NewGateway(urlConn, analyticsConn, rateLimiter, unlockLimiter, userDB, apiKeys, refreshTokens, revocations, keys, visitorIdentity, appendUTM)
 
 	mux := http.NewServeMux()
 
-	mux.HandleFunc("/api/register", gateway.handleRegister)
-	mux.HandleFunc("/api/login", gateway.handleLogin)
-	mux.HandleFunc("/api/shorten", gateway.handleCreateShortURL)
-	mux.HandleFunc("/api/urls", gateway.handleGetUserURLs)
-	mux.HandleFunc("/api/stats", gateway.handleGetStats)
-	mux.HandleFunc("/api/analytics/top", gateway.handleGetTopURLs)
-	mux.HandleFunc("/api/analytics/referers", gateway.handleGetTopReferers)
-	mux.HandleFunc("/api/analytics/hourly", gateway.handleGetHourlyDistribution)
+	authn := middleware.NewAuthenticator(apiKeys, apiKeyLimiter, gateway.ownsShortCode)
+	route := func(pattern string, req middleware.Requirement, handler http.HandlerFunc) {
+		mux.Handle(pattern, authn.Require(req, handler))
+	}
+
+	route("/api/register", middleware.Public(), gateway.handleRegister)
+	route("/api/login", middleware.Public(), gateway.handleLogin)
+	route("/api/auth/refresh", middleware.Public(), gateway.handleRefresh)
+	route("/api/auth/logout", middleware.Public(), gateway.handleLogout)
+	route("/api/auth/logout-all", middleware.Authenticated(""), gateway.handleLogoutAll)
+	route("/api/keys", middleware.Authenticated(""), gateway.handleAPIKeys)
+	route("/api/keys/", middleware.Authenticated(""), gateway.handleAPIKey)
+	route("/api/shorten", middleware.Authenticated(auth.ScopeLinksWrite), gateway.handleCreateShortURL)
+	route("/api/shorten/batch", middleware.Authenticated(auth.ScopeLinksWrite), gateway.handleBatchCreateShortURL)
+	route("/api/urls", middleware.Authenticated(auth.ScopeLinksRead), gateway.handleGetUserURLs)
+	// The URL service checks that the link belongs to the caller.
+	route("/api/urls/", middleware.Authenticated(auth.ScopeLinksWrite), gateway.handleURL)
+	// The analytics service lets the link's owner through, and anyone with
+	// its stats token.
+	route("/api/stats", middleware.Optional(auth.ScopeStatsRead), gateway.handleGetStats)
+	route("/api/stats/stream", middleware.OwnerOfCode(auth.ScopeStatsRead, middleware.CodeFromQuery), gateway.handleStatsStream)
+	route("/api/analytics/top", middleware.Admin(), gateway.handleGetTopURLs)
+	route("/api/analytics/referers", middleware.Optional(auth.ScopeStatsRead), gateway.handleGetTopReferers)
+	route("/api/analytics/hourly", middleware.Optional(auth.ScopeStatsRead), gateway.handleGetHourlyDistribution)
+	route("/api/analytics/breakdown", middleware.Optional(auth.ScopeStatsRead), gateway.handleGetBreakdown)
+	route("/api/analytics/geo", middleware.Optional(auth.ScopeStatsRead), gateway.handleGetGeoBreakdown)
+	route("/api/analytics/campaign", middleware.Authenticated(auth.ScopeStatsRead), gateway.handleGetCampaignStats)
 
 	mux.HandleFunc("/s/", gateway.handleRedirect)
+	mux.HandleFunc("/.well-known/jwks.json", gateway.handleJWKS)
 
 	fs := http.FileServer(http.Dir("/app/web/static"))
 	mux.Handle("/", fs)
 
-	handler := corsMiddleware(securityHeaders(requestSizeLimit(1024*1024)(rateLimiter.Middleware(mux))))
+	handler := corsMiddleware(securityHeaders(requestSizeLimit(1024 * 1024)(rateLimiter.Middleware(mux))))
 
 	log.Println("API Gateway started on :8080")
 	if err := http.ListenAndServe(":8080", handler); err != nil {
@@ -3,37 +3,71 @@ package main
 import (
 	"context"
 	"crypto/rand"
+	"crypto/subtle"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net"
+	"net/http"
 	"os"
+	"sort"
+	"strconv"
 	"sync"
 	"time"
 
 	pb "github.com/gorgio/network/api/proto"
+	"github.com/gorgio/network/pkg/auth"
+	"github.com/gorgio/network/pkg/database"
 	"github.com/gorgio/network/pkg/validator"
 	"github.com/redis/go-redis/v9"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	maxShortCodeAttempts = 5
+	urlCacheTTL          = 24 * time.Hour
+	// bcrypt ignores everything past 72 bytes
+	maxLinkPasswordLength = 72
+	defaultMaxBatchSize   = 500
+	defaultPageSize       = 100
+	maxPageSize           = 500
+	sortByClicks          = "clicks"
+	analyticsTimeout      = 2 * time.Second
+	// batchWorkers bounds how many batch items are validated at once, since
+	// each validation may do a DNS lookup.
+	batchWorkers = 16
+	// maxClicksSortLinks caps how many of a user's newest matching links are
+	// ranked for sort=clicks, since every page has to rank them all.
+	maxClicksSortLinks = 1000
 )
 
 type URLServiceServer struct {
 	pb.UnimplementedURLServiceServer
-	redis   *redis.Client
-	storage map[string]*URLData
-	mu      sync.RWMutex
-	baseURL string
+	redis                 *redis.Client
+	analytics             pb.AnalyticsServiceClient
+	store                 database.URLStore
+	baseURL               string
+	defaultRedirectStatus int32
+	maxBatchSize          int
 }
 
-type URLData struct {
-	ShortCode   string
-	OriginalURL string
-	UserID      string
-	CreatedAt   int64
+// cachedURL is the value stored under url:<code>.
+type cachedURL struct {
+	URL            string `json:"url"`
+	RedirectStatus int32  `json:"status"`
+	UserID         string `json:"user,omitempty"`
+	Campaign       string `json:"campaign,omitempty"`
+	Source         string `json:"source,omitempty"`
+	Medium         string `json:"medium,omitempty"`
+	ExpiresAt      int64  `json:"expires,omitempty"`
 }
 
-func NewURLServiceServer(redisClient *redis.Client) *URLServiceServer {
+func NewURLServiceServer(redisClient *redis.Client, analyticsClient pb.AnalyticsServiceClient, store database.URLStore) *URLServiceServer {
 	domain := os.Getenv("DOMAIN_NAME")
 	baseURL := "http://localhost:8080"
 
@@ -42,41 +76,37 @@ func NewURLServiceServer(redisClient *redis.Client) *URLServiceServer {
 		baseURL = "https://" + domain
 	}
 
-	server := &URLServiceServer{
-		redis:   redisClient,
-		storage: make(map[string]*URLData),
-		baseURL: baseURL,
-	}
-
-	ctx := context.Background()
-	iter := redisClient.Scan(ctx, 0, "urldata:*", 0).Iterator()
-	count := 0
-	
-	for iter.Next(ctx) {
-		key := iter.Val()
-		val, err := redisClient.Get(ctx, key).Result()
+	defaultRedirectStatus := int32(http.StatusMovedPermanently)
+	if value := os.Getenv("DEFAULT_REDIRECT_STATUS"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err == nil {
+			err = validator.ValidateRedirectStatus(int32(parsed))
+		}
 		if err != nil {
-			log.Printf("Failed to load key %s: %v", key, err)
-			continue
+			log.Printf("Ignoring DEFAULT_REDIRECT_STATUS=%s: %v", value, err)
+		} else {
+			defaultRedirectStatus = int32(parsed)
 		}
+	}
 
-		var urlData URLData
-		if err := json.Unmarshal([]byte(val), &urlData); err != nil {
-			log.Printf("Failed to unmarshal key %s: %v", key, err)
-			continue
+	maxBatchSize := defaultMaxBatchSize
+	if value := os.Getenv("MAX_BATCH_SIZE"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 {
+			log.Printf("Ignoring MAX_BATCH_SIZE=%s: must be a positive integer", value)
+		} else {
+			maxBatchSize = parsed
 		}
-
-		server.storage[urlData.ShortCode] = &urlData
-		count++
 	}
 
-	if err := iter.Err(); err != nil {
-		log.Printf("Error during Redis scan: %v", err)
+	return &URLServiceServer{
+		redis:                 redisClient,
+		analytics:             analyticsClient,
+		store:                 store,
+		baseURL:               baseURL,
+		defaultRedirectStatus: defaultRedirectStatus,
+		maxBatchSize:          maxBatchSize,
 	}
-
-	log.Printf("Restored %d URLs from Redis storage", count)
-
-	return server
 }
 
 func (s *URLServiceServer) CreateShortURL(ctx context.Context, req *pb.CreateShortURLRequest) (*pb.CreateShortURLResponse, error) {
@@ -84,67 +114,91 @@ func (s *URLServiceServer) CreateShortURL(ctx context.Context, req *pb.CreateSho
 		req.OriginalUrl, req.UserId, req.CustomAlias)
 
 	if err := validator.ValidateURL(req.OriginalUrl); err != nil {
-		return nil, fmt.Errorf("invalid URL: %w", err)
+		return nil, status.Errorf(codes.InvalidArgument, "invalid URL: %v", err)
 	}
 
 	userID := validator.SanitizeInput(req.UserId)
 	if userID == "" {
-		return nil, fmt.Errorf("user ID is required")
+		return nil, status.Error(codes.Unauthenticated, "user ID is required")
 	}
 
-	var shortCode string
 	if req.CustomAlias != "" {
 		if err := validator.ValidateShortCode(req.CustomAlias); err != nil {
-			return nil, fmt.Errorf("invalid custom alias: %w", err)
+			return nil, status.Errorf(codes.InvalidArgument, "invalid custom alias: %v", err)
 		}
-		shortCode = req.CustomAlias
+	}
 
-		s.mu.RLock()
-		_, exists := s.storage[shortCode]
-		s.mu.RUnlock()
-		if exists {
-			return nil, fmt.Errorf("alias already exists")
+	if req.RedirectStatus != 0 {
+		if err := validator.ValidateRedirectStatus(req.RedirectStatus); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
 		}
-	} else {
-		shortCode = generateShortCode()
 	}
 
-	createdAt := time.Now().Unix()
-	urlData := &URLData{
-		ShortCode:   shortCode,
-		OriginalURL: req.OriginalUrl,
-		UserID:      userID,
-		CreatedAt:   createdAt,
+	campaignTags := []struct{ name, value string }{
+		{"campaign", req.Campaign},
+		{"source", req.Source},
+		{"medium", req.Medium},
+	}
+	for _, tag := range campaignTags {
+		if err := validator.ValidateCampaignTag(tag.value); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "%s %v", tag.name, err)
+		}
 	}
 
-	s.mu.Lock()
-	s.storage[shortCode] = urlData
-	s.mu.Unlock()
+	now := time.Now()
+	if req.ExpiresAt != 0 && req.ExpiresAt <= now.Unix() {
+		return nil, status.Error(codes.InvalidArgument, "expiration time must be in the future")
+	}
+	if req.MaxClicks < 0 {
+		return nil, status.Error(codes.InvalidArgument, "max clicks cannot be negative")
+	}
 
-	jsonData, err := json.Marshal(urlData)
-	if err != nil {
-		log.Printf("Failed to marshal URL data: %v", err)
-	} else {
-		persistKey := validator.SanitizeRedisKey(fmt.Sprintf("urldata:%s", shortCode))
-		err := s.redis.Set(ctx, persistKey, jsonData, 0).Err()
+	createdAt := now.Unix()
+	urlData := &database.URLData{
+		OriginalURL:    req.OriginalUrl,
+		UserID:         userID,
+		CreatedAt:      createdAt,
+		ExpiresAt:      req.ExpiresAt,
+		MaxClicks:      req.MaxClicks,
+		RedirectStatus: req.RedirectStatus,
+		Campaign:       req.Campaign,
+		Source:         req.Source,
+		Medium:         req.Medium,
+	}
+
+	if req.Password != "" {
+		if len(req.Password) > maxLinkPasswordLength {
+			return nil, status.Errorf(codes.InvalidArgument, "password must be at most %d bytes", maxLinkPasswordLength)
+		}
+		passwordHash, err := database.HashPassword(req.Password)
 		if err != nil {
-			log.Printf("Failed to persist in Redis: %v", err)
+			log.Printf("Failed to hash link password: %v", err)
+			return nil, status.Error(codes.Internal, "failed to store URL")
 		}
+		urlData.PasswordHash = passwordHash
 	}
 
-	cacheKey := validator.SanitizeRedisKey(fmt.Sprintf("url:%s", shortCode))
-	err = s.redis.Set(ctx, cacheKey, req.OriginalUrl, 24*time.Hour).Err()
-	if err != nil {
-		log.Printf("Failed to cache in Redis: %v", err)
+	if err := s.reserveShortCode(ctx, urlData, req.CustomAlias); err != nil {
+		return nil, err
 	}
+	shortCode := urlData.ShortCode
+
+	s.cacheURL(ctx, urlData, now)
 
 	log.Printf("Created short URL: %s -> %s", shortCode, req.OriginalUrl)
 
 	return &pb.CreateShortURLResponse{
-		ShortCode:   shortCode,
-		ShortUrl:    fmt.Sprintf("%s/s/%s", s.baseURL, shortCode),
-		OriginalUrl: req.OriginalUrl,
-		CreatedAt:   createdAt,
+		ShortCode:         shortCode,
+		ShortUrl:          fmt.Sprintf("%s/s/%s", s.baseURL, shortCode),
+		OriginalUrl:       req.OriginalUrl,
+		CreatedAt:         createdAt,
+		ExpiresAt:         urlData.ExpiresAt,
+		MaxClicks:         urlData.MaxClicks,
+		PasswordProtected: urlData.PasswordHash != "",
+		RedirectStatus:    s.redirectStatus(urlData),
+		Campaign:          urlData.Campaign,
+		Source:            urlData.Source,
+		Medium:            urlData.Medium,
 	}, nil
 }
 
@@ -155,63 +209,680 @@ func (s *URLServiceServer) GetOriginalURL(ctx context.Context, req *pb.GetOrigin
 		return &pb.GetOriginalURLResponse{Found: false}, nil
 	}
 
-	cacheKey := validator.SanitizeRedisKey(fmt.Sprintf("url:%s", req.ShortCode))
-	cachedURL, err := s.redis.Get(ctx, cacheKey).Result()
-	if err == nil {
-		log.Printf("Cache hit for %s: %s", req.ShortCode, cachedURL)
+	if cached, ok := s.lookupCache(ctx, req.ShortCode); ok {
+		log.Printf("Cache hit for %s: %s", req.ShortCode, cached.URL)
 		return &pb.GetOriginalURLResponse{
-			OriginalUrl: cachedURL,
-			Found:       true,
+			OriginalUrl:    cached.URL,
+			Found:          true,
+			RedirectStatus: cached.RedirectStatus,
+			Campaign:       cached.Campaign,
+			Source:         cached.Source,
+			Medium:         cached.Medium,
+			UserId:         cached.UserID,
+			ExpiresAt:      cached.ExpiresAt,
 		}, nil
 	}
 
-	s.mu.RLock()
-	urlData, exists := s.storage[req.ShortCode]
-	s.mu.RUnlock()
+	urlData, err := s.store.Get(ctx, req.ShortCode)
+	if err != nil {
+		if errors.Is(err, database.ErrURLNotFound) {
+			log.Printf("Short code not found: %s", req.ShortCode)
+			return &pb.GetOriginalURLResponse{
+				Found: false,
+			}, nil
+		}
+		log.Printf("Failed to load URL %s: %v", req.ShortCode, err)
+		return nil, fmt.Errorf("failed to load URL")
+	}
+
+	now := time.Now()
+	if urlData.Expired(now) {
+		log.Printf("Short code expired: %s", req.ShortCode)
+		return &pb.GetOriginalURLResponse{Found: true, Expired: true}, nil
+	}
 
-	if !exists {
-		log.Printf("Short code not found: %s", req.ShortCode)
-		return &pb.GetOriginalURLResponse{
-			Found: false,
-		}, nil
+	protected := urlData.PasswordHash != ""
+	if protected && !req.Unlocked {
+		return &pb.GetOriginalURLResponse{Found: true, PasswordProtected: true}, nil
+	}
+
+	if urlData.MaxClicks > 0 {
+		// Link previews would otherwise use up a one-time link before the
+		// person it was sent to opens it. The destination is withheld too, or
+		// a faked User-Agent would get around the cap.
+		if req.IsBot {
+			log.Printf("Withheld click-capped %s from a bot", req.ShortCode)
+			return &pb.GetOriginalURLResponse{Found: true, WithheldFromBot: true}, nil
+		}
+
+		err := s.store.ConsumeClick(ctx, req.ShortCode)
+		if errors.Is(err, database.ErrURLExpired) {
+			log.Printf("Short code reached its click limit: %s", req.ShortCode)
+			return &pb.GetOriginalURLResponse{Found: true, Expired: true}, nil
+		}
+		if err != nil {
+			log.Printf("Failed to count click for %s: %v", req.ShortCode, err)
+			return nil, fmt.Errorf("failed to load URL")
+		}
 	}
 
-	s.redis.Set(ctx, cacheKey, urlData.OriginalURL, 24*time.Hour)
+	s.cacheURL(ctx, urlData, now)
 
 	log.Printf("Found URL: %s -> %s", req.ShortCode, urlData.OriginalURL)
 
 	return &pb.GetOriginalURLResponse{
-		OriginalUrl: urlData.OriginalURL,
-		Found:       true,
+		OriginalUrl:       urlData.OriginalURL,
+		Found:             true,
+		PasswordProtected: protected,
+		RedirectStatus:    s.redirectStatus(urlData),
+		Campaign:          urlData.Campaign,
+		Source:            urlData.Source,
+		Medium:            urlData.Medium,
+		UserId:            urlData.UserID,
+		ClickCapped:       urlData.MaxClicks > 0,
+		ExpiresAt:         urlData.ExpiresAt,
 	}, nil
 }
 
 func (s *URLServiceServer) GetUserURLs(ctx context.Context, req *pb.GetUserURLsRequest) (*pb.GetUserURLsResponse, error) {
-	log.Printf("GetUserURLs request: user_id=%s", req.UserId)
+	log.Printf("GetUserURLs request: user_id=%s, page_size=%d, page_token=%s, sort=%s, query=%s",
+		req.UserId, req.PageSize, req.PageToken, req.Sort, req.Query)
+
+	pageSize := int(req.PageSize)
+	if pageSize <= 0 {
+		pageSize = defaultPageSize
+	}
+	if pageSize > maxPageSize {
+		pageSize = maxPageSize
+	}
+
+	offset, err := decodePageToken(req.PageToken)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, "invalid page token")
+	}
+
+	sortBy := req.Sort
+	if sortBy == "" {
+		sortBy = database.SortByCreatedAt
+	}
+
+	opts := database.ListOptions{
+		Query:  req.Query,
+		SortBy: sortBy,
+		Offset: offset,
+		Limit:  pageSize + 1,
+	}
+
+	// Click totals live in analytics, so that ordering is applied here over
+	// the user's newest matching links instead of in the store.
+	if sortBy == sortByClicks {
+		opts.SortBy = database.SortByCreatedAt
+		opts.Offset = 0
+		opts.Limit = maxClicksSortLinks
+	}
+
+	stored, err := s.store.ListByUser(ctx, req.UserId, opts)
+	if err != nil {
+		if errors.Is(err, database.ErrInvalidSort) {
+			return nil, status.Error(codes.InvalidArgument, "sort must be created_at, clicks or alias")
+		}
+		log.Printf("Failed to list URLs for user %s: %v", req.UserId, err)
+		return nil, fmt.Errorf("failed to list URLs")
+	}
+
+	resp := &pb.GetUserURLsResponse{}
+	var clicks map[string]int64
+
+	if sortBy == sortByClicks {
+		clicks, err = s.clickCounts(ctx, stored)
+		resp.ClicksUnavailable = err != nil
+
+		sort.SliceStable(stored, func(i, j int) bool {
+			return clicks[stored[i].ShortCode] > clicks[stored[j].ShortCode]
+		})
+
+		if offset >= len(stored) {
+			stored = nil
+		} else {
+			stored = stored[offset:]
+		}
+	}
+
+	if len(stored) > pageSize {
+		stored = stored[:pageSize]
+		resp.NextPageToken = encodePageToken(offset + pageSize)
+	}
+
+	if sortBy != sortByClicks {
+		clicks, err = s.clickCounts(ctx, stored)
+		resp.ClicksUnavailable = err != nil
+	}
+
+	resp.Urls = make([]*pb.URLInfo, 0, len(stored))
+	for _, urlData := range stored {
+		info := s.urlInfo(urlData)
+		info.Clicks = clicks[urlData.ShortCode]
+		resp.Urls = append(resp.Urls, info)
+	}
+
+	log.Printf("Found %d URLs for user %s", len(resp.Urls), req.UserId)
 
-	urls := make([]*pb.URLInfo, 0)
+	return resp, nil
+}
+
+// GetShortURL returns a link to its owner. Other services call it to check
+// ownership before showing anything about the link.
+func (s *URLServiceServer) GetShortURL(ctx context.Context, req *pb.GetShortURLRequest) (*pb.GetShortURLResponse, error) {
+	log.Printf("GetShortURL request: short_code=%s, user_id=%s", req.ShortCode, req.UserId)
+
+	urlData, err := s.loadOwnedURL(ctx, req.ShortCode, req.UserId)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.GetShortURLResponse{
+		Url: s.urlInfo(urlData),
+	}, nil
+}
+
+// AuthorizeStats lets the owner of a link, or anyone holding its stats
+// token, read its analytics. The analytics service asks before every read.
+func (s *URLServiceServer) AuthorizeStats(ctx context.Context, req *pb.AuthorizeStatsRequest) (*pb.AuthorizeStatsResponse, error) {
+	log.Printf("AuthorizeStats request: short_code=%s, user_id=%s, token=%t", req.ShortCode, req.UserId, req.StatsToken != "")
+
+	if err := validator.ValidateShortCode(req.ShortCode); err != nil {
+		return nil, status.Error(codes.InvalidArgument, "invalid short code")
+	}
+
+	urlData, err := s.store.Get(ctx, req.ShortCode)
+	if err != nil {
+		if errors.Is(err, database.ErrURLNotFound) {
+			return nil, status.Error(codes.NotFound, "short URL not found")
+		}
+		log.Printf("Failed to load URL %s: %v", req.ShortCode, err)
+		return nil, status.Error(codes.Internal, "failed to load URL")
+	}
+
+	if req.UserId != "" && urlData.UserID == req.UserId {
+		return &pb.AuthorizeStatsResponse{}, nil
+	}
+
+	if req.StatsToken != "" && urlData.StatsTokenHash != "" &&
+		subtle.ConstantTimeCompare([]byte(auth.HashStatsToken(req.StatsToken)), []byte(urlData.StatsTokenHash)) == 1 {
+		return &pb.AuthorizeStatsResponse{}, nil
+	}
+
+	if req.UserId == "" && req.StatsToken == "" {
+		return nil, status.Error(codes.Unauthenticated, "sign in or use a stats token to view these stats")
+	}
+	if req.StatsToken != "" {
+		return nil, status.Error(codes.PermissionDenied, "invalid stats token")
+	}
+	return nil, status.Error(codes.PermissionDenied, "short URL belongs to another user")
+}
+
+// SetStatsSharing issues a new stats token for a link, which replaces any
+// previous one, or disables sharing. Only the token's hash is stored, so the
+// token can be read only from the response.
+func (s *URLServiceServer) SetStatsSharing(ctx context.Context, req *pb.SetStatsSharingRequest) (*pb.SetStatsSharingResponse, error) {
+	log.Printf("SetStatsSharing request: short_code=%s, user_id=%s, enabled=%t", req.ShortCode, req.UserId, req.Enabled)
+
+	urlData, err := s.loadOwnedURL(ctx, req.ShortCode, req.UserId)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &pb.SetStatsSharingResponse{}
+	urlData.StatsTokenHash = ""
+	if req.Enabled {
+		resp.StatsToken, urlData.StatsTokenHash, err = auth.NewStatsToken()
+		if err != nil {
+			return nil, status.Error(codes.Internal, "failed to generate stats token")
+		}
+	}
+
+	if err := s.store.Update(ctx, req.ShortCode, urlData); err != nil {
+		if errors.Is(err, database.ErrURLNotFound) {
+			return nil, status.Error(codes.NotFound, "short URL not found")
+		}
+		log.Printf("Failed to update stats sharing of %s: %v", req.ShortCode, err)
+		return nil, status.Error(codes.Internal, "failed to update URL")
+	}
+
+	return resp, nil
+}
+
+func (s *URLServiceServer) UpdateShortURL(ctx context.Context, req *pb.UpdateShortURLRequest) (*pb.UpdateShortURLResponse, error) {
+	log.Printf("UpdateShortURL request: short_code=%s, user_id=%s, original_url=%s, custom_alias=%s",
+		req.ShortCode, req.UserId, req.OriginalUrl, req.CustomAlias)
+
+	urlData, err := s.loadOwnedURL(ctx, req.ShortCode, req.UserId)
+	if err != nil {
+		return nil, err
+	}
+	// Clicks so far were counted under the campaign the link had before.
+	campaign := urlData.Campaign
+
+	if req.OriginalUrl != "" {
+		if err := validator.ValidateURL(req.OriginalUrl); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid URL: %v", err)
+		}
+		urlData.OriginalURL = req.OriginalUrl
+	}
+
+	if req.CustomAlias != "" && req.CustomAlias != req.ShortCode {
+		if err := validator.ValidateShortCode(req.CustomAlias); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid custom alias: %v", err)
+		}
+		urlData.ShortCode = req.CustomAlias
+	}
+
+	if req.RedirectStatus != 0 {
+		if err := validator.ValidateRedirectStatus(req.RedirectStatus); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		urlData.RedirectStatus = req.RedirectStatus
+	}
+
+	if req.ExpiresAt != nil {
+		if *req.ExpiresAt != 0 && *req.ExpiresAt <= time.Now().Unix() {
+			return nil, status.Error(codes.InvalidArgument, "expiration time must be in the future")
+		}
+		urlData.ExpiresAt = *req.ExpiresAt
+	}
+
+	if req.MaxClicks != nil {
+		if *req.MaxClicks < 0 {
+			return nil, status.Error(codes.InvalidArgument, "max clicks cannot be negative")
+		}
+		urlData.MaxClicks = *req.MaxClicks
+	}
+
+	campaignTags := []struct {
+		name  string
+		value *string
+		field *string
+	}{
+		{"campaign", req.Campaign, &urlData.Campaign},
+		{"source", req.Source, &urlData.Source},
+		{"medium", req.Medium, &urlData.Medium},
+	}
+	for _, tag := range campaignTags {
+		if tag.value == nil {
+			continue
+		}
+		if err := validator.ValidateCampaignTag(*tag.value); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "%s %v", tag.name, err)
+		}
+		*tag.field = *tag.value
+	}
 
-	s.mu.RLock()
-	for _, urlData := range s.storage {
-		if urlData.UserID == req.UserId {
-			urls = append(urls, &pb.URLInfo{
-				ShortCode:   urlData.ShortCode,
-				ShortUrl:    fmt.Sprintf("%s/s/%s", s.baseURL, urlData.ShortCode),
-				OriginalUrl: urlData.OriginalURL,
-				CreatedAt:   urlData.CreatedAt,
-				Clicks:      0,
-			})
+	err = s.store.Update(ctx, req.ShortCode, urlData)
+	if err != nil {
+		switch {
+		case errors.Is(err, database.ErrShortCodeTaken):
+			return nil, status.Errorf(codes.AlreadyExists, "alias %s already exists", urlData.ShortCode)
+		case errors.Is(err, database.ErrURLNotFound):
+			return nil, status.Error(codes.NotFound, "short URL not found")
 		}
+		log.Printf("Failed to update URL %s: %v", req.ShortCode, err)
+		return nil, status.Error(codes.Internal, "failed to update URL")
+	}
+
+	s.invalidateCache(ctx, req.ShortCode, urlData.ShortCode)
+	if urlData.ShortCode != req.ShortCode {
+		s.renameClicks(ctx, req.ShortCode, urlData.ShortCode, urlData.UserID, campaign)
 	}
-	s.mu.RUnlock()
 
-	log.Printf("Found %d URLs for user %s", len(urls), req.UserId)
+	log.Printf("Updated short URL: %s -> %s (%s)", req.ShortCode, urlData.ShortCode, urlData.OriginalURL)
 
-	return &pb.GetUserURLsResponse{
-		Urls: urls,
+	return &pb.UpdateShortURLResponse{
+		Url: s.urlInfo(urlData),
 	}, nil
 }
 
+func (s *URLServiceServer) DeleteShortURL(ctx context.Context, req *pb.DeleteShortURLRequest) (*pb.DeleteShortURLResponse, error) {
+	log.Printf("DeleteShortURL request: short_code=%s, user_id=%s", req.ShortCode, req.UserId)
+
+	if _, err := s.loadOwnedURL(ctx, req.ShortCode, req.UserId); err != nil {
+		return nil, err
+	}
+
+	err := s.store.Delete(ctx, req.ShortCode)
+	if err != nil {
+		if errors.Is(err, database.ErrURLNotFound) {
+			return nil, status.Error(codes.NotFound, "short URL not found")
+		}
+		log.Printf("Failed to delete URL %s: %v", req.ShortCode, err)
+		return nil, status.Error(codes.Internal, "failed to delete URL")
+	}
+
+	s.invalidateCache(ctx, req.ShortCode)
+	s.purgeClicks(ctx, req.ShortCode)
+
+	log.Printf("Deleted short URL: %s", req.ShortCode)
+
+	return &pb.DeleteShortURLResponse{Success: true}, nil
+}
+
+func (s *URLServiceServer) VerifyURLPassword(ctx context.Context, req *pb.VerifyURLPasswordRequest) (*pb.VerifyURLPasswordResponse, error) {
+	log.Printf("VerifyURLPassword request: short_code=%s", req.ShortCode)
+
+	if err := validator.ValidateShortCode(req.ShortCode); err != nil {
+		return nil, status.Error(codes.InvalidArgument, "invalid short code")
+	}
+
+	urlData, err := s.store.Get(ctx, req.ShortCode)
+	if err != nil {
+		if errors.Is(err, database.ErrURLNotFound) {
+			return nil, status.Error(codes.NotFound, "short URL not found")
+		}
+		log.Printf("Failed to load URL %s: %v", req.ShortCode, err)
+		return nil, status.Error(codes.Internal, "failed to load URL")
+	}
+
+	if urlData.PasswordHash == "" {
+		return &pb.VerifyURLPasswordResponse{Valid: true}, nil
+	}
+
+	return &pb.VerifyURLPasswordResponse{
+		Valid: database.CheckPassword(urlData.PasswordHash, req.Password),
+	}, nil
+}
+
+// BatchCreateShortURL creates every item independently, so valid rows are
+// stored even when others fail. Results come back in request order.
+func (s *URLServiceServer) BatchCreateShortURL(ctx context.Context, req *pb.BatchCreateShortURLRequest) (*pb.BatchCreateShortURLResponse, error) {
+	log.Printf("BatchCreateShortURL request: user_id=%s, items=%d", req.UserId, len(req.Items))
+
+	if len(req.Items) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "batch is empty")
+	}
+
+	if len(req.Items) > s.maxBatchSize {
+		return nil, status.Errorf(codes.InvalidArgument, "batch has %d items, the limit is %d", len(req.Items), s.maxBatchSize)
+	}
+
+	results := make([]*pb.BatchCreateResult, len(req.Items))
+	sem := make(chan struct{}, batchWorkers)
+	var wg sync.WaitGroup
+
+	for i, item := range req.Items {
+		wg.Add(1)
+		go func(i int, item *pb.CreateShortURLRequest) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			item.UserId = req.UserId
+			result := &pb.BatchCreateResult{Index: int32(i)}
+
+			resp, err := s.CreateShortURL(ctx, item)
+			if err != nil {
+				result.Error = status.Convert(err).Message()
+			} else {
+				result.Url = resp
+			}
+			results[i] = result
+		}(i, item)
+	}
+
+	wg.Wait()
+
+	resp := &pb.BatchCreateShortURLResponse{Results: results}
+	for _, result := range results {
+		if result.Error != "" {
+			resp.Failed++
+		} else {
+			resp.Created++
+		}
+	}
+
+	log.Printf("Batch for user %s: created=%d, failed=%d", req.UserId, resp.Created, resp.Failed)
+
+	return resp, nil
+}
+
+func (s *URLServiceServer) urlInfo(urlData *database.URLData) *pb.URLInfo {
+	return &pb.URLInfo{
+		ShortCode:         urlData.ShortCode,
+		ShortUrl:          fmt.Sprintf("%s/s/%s", s.baseURL, urlData.ShortCode),
+		OriginalUrl:       urlData.OriginalURL,
+		CreatedAt:         urlData.CreatedAt,
+		ExpiresAt:         urlData.ExpiresAt,
+		MaxClicks:         urlData.MaxClicks,
+		PasswordProtected: urlData.PasswordHash != "",
+		RedirectStatus:    s.redirectStatus(urlData),
+		Campaign:          urlData.Campaign,
+		Source:            urlData.Source,
+		Medium:            urlData.Medium,
+		StatsShared:       urlData.StatsTokenHash != "",
+	}
+}
+
+// clickCounts fetches click totals from the analytics service. Callers treat
+// an error as "counts unavailable" and show zeros rather than failing.
+func (s *URLServiceServer) clickCounts(ctx context.Context, urls []*database.URLData) (map[string]int64, error) {
+	if len(urls) == 0 {
+		return map[string]int64{}, nil
+	}
+
+	shortCodes := make([]string, 0, len(urls))
+	for _, urlData := range urls {
+		shortCodes = append(shortCodes, urlData.ShortCode)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, analyticsTimeout)
+	defer cancel()
+
+	resp, err := s.analytics.GetClickCounts(ctx, &pb.GetClickCountsRequest{
+		ShortCodes: shortCodes,
+	})
+	if err != nil {
+		log.Printf("Warning: click counts unavailable: %v", err)
+		return map[string]int64{}, err
+	}
+
+	return resp.Counts, nil
+}
+
+// purgeClicks has the analytics service forget the code of a deleted link, so
+// that the next link to take the code starts without clicks. The link is
+// already gone, so a failure is only logged.
+func (s *URLServiceServer) purgeClicks(ctx context.Context, shortCode string) {
+	ctx, cancel := context.WithTimeout(ctx, analyticsTimeout)
+	defer cancel()
+
+	if _, err := s.analytics.PurgeClicks(ctx, &pb.PurgeClicksRequest{ShortCode: shortCode}); err != nil {
+		log.Printf("Warning: clicks of %s were not purged: %v", shortCode, err)
+	}
+}
+
+// renameClicks has the analytics service move a renamed link's clicks to its
+// new code. The rename has already happened, so a failure is only logged.
+func (s *URLServiceServer) renameClicks(ctx context.Context, shortCode, newShortCode, ownerID, campaign string) {
+	ctx, cancel := context.WithTimeout(ctx, analyticsTimeout)
+	defer cancel()
+
+	_, err := s.analytics.RenameClicks(ctx, &pb.RenameClicksRequest{
+		ShortCode:    shortCode,
+		NewShortCode: newShortCode,
+		OwnerId:      ownerID,
+		Campaign:     campaign,
+	})
+	if err != nil {
+		log.Printf("Warning: clicks of %s were not moved to %s: %v", shortCode, newShortCode, err)
+	}
+}
+
+func encodePageToken(offset int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.Itoa(offset)))
+}
+
+func decodePageToken(token string) (int, error) {
+	if token == "" {
+		return 0, nil
+	}
+
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return 0, err
+	}
+
+	offset, err := strconv.Atoi(string(raw))
+	if err != nil || offset < 0 {
+		return 0, fmt.Errorf("invalid offset")
+	}
+
+	return offset, nil
+}
+
+func (s *URLServiceServer) redirectStatus(urlData *database.URLData) int32 {
+	if urlData.RedirectStatus != 0 {
+		return urlData.RedirectStatus
+	}
+	return s.defaultRedirectStatus
+}
+
+// lookupCache reads the url:<code> entry. Entries written before redirect
+// statuses existed hold the bare URL and get the server default status.
+func (s *URLServiceServer) lookupCache(ctx context.Context, shortCode string) (*cachedURL, bool) {
+	cacheKey := validator.SanitizeRedisKey(fmt.Sprintf("url:%s", shortCode))
+	val, err := s.redis.Get(ctx, cacheKey).Result()
+	if err != nil {
+		return nil, false
+	}
+
+	var cached cachedURL
+	if err := json.Unmarshal([]byte(val), &cached); err != nil {
+		return &cachedURL{URL: val, RedirectStatus: s.defaultRedirectStatus}, true
+	}
+
+	return &cached, true
+}
+
+func (s *URLServiceServer) cacheURL(ctx context.Context, urlData *database.URLData, now time.Time) {
+	ttl, ok := cacheTTL(urlData, now)
+	if !ok {
+		return
+	}
+
+	jsonData, err := json.Marshal(cachedURL{
+		URL:            urlData.OriginalURL,
+		RedirectStatus: s.redirectStatus(urlData),
+		UserID:         urlData.UserID,
+		Campaign:       urlData.Campaign,
+		Source:         urlData.Source,
+		Medium:         urlData.Medium,
+		ExpiresAt:      urlData.ExpiresAt,
+	})
+	if err != nil {
+		log.Printf("Failed to marshal cache entry: %v", err)
+		return
+	}
+
+	cacheKey := validator.SanitizeRedisKey(fmt.Sprintf("url:%s", urlData.ShortCode))
+	if err := s.redis.Set(ctx, cacheKey, jsonData, ttl).Err(); err != nil {
+		log.Printf("Failed to cache in Redis: %v", err)
+	}
+}
+
+// loadOwnedURL fetches a link and checks that userID owns it.
+func (s *URLServiceServer) loadOwnedURL(ctx context.Context, shortCode, userID string) (*database.URLData, error) {
+	if err := validator.ValidateShortCode(shortCode); err != nil {
+		return nil, status.Error(codes.InvalidArgument, "invalid short code")
+	}
+
+	if userID == "" {
+		return nil, status.Error(codes.Unauthenticated, "user ID is required")
+	}
+
+	urlData, err := s.store.Get(ctx, shortCode)
+	if err != nil {
+		if errors.Is(err, database.ErrURLNotFound) {
+			return nil, status.Error(codes.NotFound, "short URL not found")
+		}
+		log.Printf("Failed to load URL %s: %v", shortCode, err)
+		return nil, status.Error(codes.Internal, "failed to load URL")
+	}
+
+	if urlData.UserID != userID {
+		return nil, status.Error(codes.PermissionDenied, "short URL belongs to another user")
+	}
+
+	return urlData, nil
+}
+
+// invalidateCache drops the url:<code> lookup cache for each code so the
+// next redirect reads through to the store.
+func (s *URLServiceServer) invalidateCache(ctx context.Context, shortCodes ...string) {
+	keys := make([]string, 0, len(shortCodes))
+	for _, code := range shortCodes {
+		keys = append(keys, validator.SanitizeRedisKey(fmt.Sprintf("url:%s", code)))
+	}
+
+	if err := s.redis.Del(ctx, keys...).Err(); err != nil {
+		log.Printf("Failed to invalidate cache for %v: %v", shortCodes, err)
+	}
+}
+
+// cacheTTL returns how long the url:<code> entry may live. Click-capped and
+// password-protected links are never cached because every redirect has to go
+// through the counter or the password check, and links with an expiry are
+// cached no longer than their remaining lifetime.
+func cacheTTL(urlData *database.URLData, now time.Time) (time.Duration, bool) {
+	if urlData.MaxClicks > 0 || urlData.PasswordHash != "" {
+		return 0, false
+	}
+
+	ttl := urlCacheTTL
+	if urlData.ExpiresAt != 0 {
+		remaining := time.Unix(urlData.ExpiresAt, 0).Sub(now)
+		if remaining <= 0 {
+			return 0, false
+		}
+		ttl = min(ttl, remaining)
+	}
+
+	return ttl, true
+}
+
+// reserveShortCode stores urlData under alias, or under a freshly generated
+// code when alias is empty. The store's uniqueness check is the only arbiter,
+// so two replicas racing for the same code cannot both win.
+func (s *URLServiceServer) reserveShortCode(ctx context.Context, urlData *database.URLData, alias string) error {
+	if alias != "" {
+		urlData.ShortCode = alias
+		err := s.store.Create(ctx, urlData)
+		if errors.Is(err, database.ErrShortCodeTaken) {
+			return status.Errorf(codes.AlreadyExists, "alias %s already exists", alias)
+		}
+		if err != nil {
+			log.Printf("Failed to store URL %s: %v", alias, err)
+			return status.Error(codes.Internal, "failed to store URL")
+		}
+		return nil
+	}
+
+	for attempt := 0; attempt < maxShortCodeAttempts; attempt++ {
+		urlData.ShortCode = generateShortCode()
+		err := s.store.Create(ctx, urlData)
+		if err == nil {
+			return nil
+		}
+		if !errors.Is(err, database.ErrShortCodeTaken) {
+			log.Printf("Failed to store URL %s: %v", urlData.ShortCode, err)
+			return status.Error(codes.Internal, "failed to store URL")
+		}
+		log.Printf("Generated short code %s collided, retrying", urlData.ShortCode)
+	}
+
+	// Only a caller's own alias can clash with theirs; running out of
+	// generated codes is the service's problem.
+	log.Printf("Gave up generating a short code after %d collisions", maxShortCodeAttempts)
+	return status.Error(codes.Internal, "failed to generate a unique short code")
+}
+
 func generateShortCode() string {
 	b := make([]byte, 6)
 	rand.Read(b)
@@ -220,6 +891,73 @@ func generateShortCode() string {
 	return code
 }
 
+// newURLStore picks the link storage backend from URL_STORE. PostgreSQL is the
+// default; "memory" is only meant for local runs and tests.
+func newURLStore() (database.URLStore, func()) {
+	if os.Getenv("URL_STORE") == "memory" {
+		log.Println("Warning: using in-memory URL store, links will be lost on restart")
+		return database.NewMemoryURLStore(), func() {}
+	}
+
+	databaseURL := os.Getenv("DATABASE_URL")
+	if databaseURL == "" {
+		log.Fatal("DATABASE_URL environment variable is not set")
+	}
+
+	urlDB, err := database.NewURLDB(databaseURL)
+	if err != nil {
+		log.Fatalf("Failed to connect to database: %v", err)
+	}
+	log.Println("Connected to PostgreSQL")
+
+	return urlDB, func() { urlDB.Close() }
+}
+
+// importLegacyURLs moves links persisted by older releases under urldata:*
+// into the store. Each key is deleted once its link is in the store, so links
+// deleted or renamed later are not imported again on the next start. Codes
+// that already exist are skipped, which makes it safe to run on every start.
+func importLegacyURLs(ctx context.Context, redisClient *redis.Client, store database.URLStore) {
+	iter := redisClient.Scan(ctx, 0, "urldata:*", 0).Iterator()
+	count := 0
+
+	for iter.Next(ctx) {
+		key := iter.Val()
+		val, err := redisClient.Get(ctx, key).Result()
+		if err != nil {
+			log.Printf("Failed to load key %s: %v", key, err)
+			continue
+		}
+
+		var urlData database.URLData
+		if err := json.Unmarshal([]byte(val), &urlData); err != nil {
+			log.Printf("Failed to unmarshal key %s: %v", key, err)
+			continue
+		}
+
+		err = store.Create(ctx, &urlData)
+		if err != nil && !errors.Is(err, database.ErrShortCodeTaken) {
+			log.Printf("Failed to import key %s: %v", key, err)
+			continue
+		}
+		if err == nil {
+			count++
+		}
+
+		if err := redisClient.Del(ctx, key).Err(); err != nil {
+			log.Printf("Failed to delete imported key %s: %v", key, err)
+		}
+	}
+
+	if err := iter.Err(); err != nil {
+		log.Printf("Error during Redis scan: %v", err)
+	}
+
+	if count > 0 {
+		log.Printf("Imported %d legacy URLs from Redis", count)
+	}
+}
+
 func main() {
 	redisClient := redis.NewClient(&redis.Options{
 		Addr: "redis:6379",
@@ -232,13 +970,24 @@ func main() {
 		log.Println("Connected to Redis")
 	}
 
+	store, closeStore := newURLStore()
+	defer closeStore()
+
+	importLegacyURLs(ctx, redisClient, store)
+
+	analyticsConn, err := grpc.Dial("analytics:8082", grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		log.Fatalf("Failed to connect to Analytics service: %v", err)
+	}
+	defer analyticsConn.Close()
+
 	lis, err := net.Listen("tcp", ":8081")
 	if err != nil {
 		log.Fatalf("Failed to listen: %v", err)
 	}
 
 	grpcServer := grpc.NewServer()
-	pb.RegisterURLServiceServer(grpcServer, NewURLServiceServer(redisClient))
+	pb.RegisterURLServiceServer(grpcServer, NewURLServiceServer(redisClient, pb.NewAnalyticsServiceClient(analyticsConn), store))
 
 	log.Println("URL Service started on :8081")
 	if err := grpcServer.Serve(lis); err != nil {
@@ -1,5 +1,11 @@
 let authToken = localStorage.getItem('authToken');
+let refreshToken = localStorage.getItem('refreshToken');
 let currentUser = localStorage.getItem('currentUser');
+// Live click counter for the link whose stats are open, see streamStats.
+let liveStats = null;
+// Links shown so far; /api/urls hands them out a page at a time.
+let userUrls = [];
+let urlsPageToken = '';
 
 const translations = {
     en: {
@@ -22,10 +28,12 @@ const translations = {
         copy_btn: "Copy",
         your_urls: "Your URLs",
         refresh_btn: "Refresh",
+        load_more_btn: "Load more",
         stats_btn: "Stats",
         created: "Created:",
         clicks: "Clicks:",
         unique: "unique",
+        live: "live",
         no_urls_message: "No URLs yet. Create your first short URL!"
     },
     ru: {
@@ -48,10 +56,12 @@ const translations = {
         copy_btn: "Копировать",
         your_urls: "Ваши ссылки",
         refresh_btn: "Обновить",
+        load_more_btn: "Загрузить ещё",
         stats_btn: "Статистика",
         created: "Создано:",
         clicks: "Клики:",
         unique: "уникальных",
+        live: "в реальном времени",
         no_urls_message: "Пока нет ссылок. Создайте свою первую короткую ссылку!"
     }
 };
@@ -146,11 +156,7 @@ async function register() {
         }
 
         const data = await response.json();
-        authToken = data.token;
-        currentUser = data.user_id;
-
-        localStorage.setItem('authToken', authToken);
-        localStorage.setItem('currentUser', currentUser);
+        saveSession(data);
 
         // Clear form
         document.getElementById('regUsername').value = '';
@@ -189,11 +195,7 @@ async function login() {
         }
 
         const data = await response.json();
-        authToken = data.token;
-        currentUser = data.user_id;
-
-        localStorage.setItem('authToken', authToken);
-        localStorage.setItem('currentUser', currentUser);
+        saveSession(data);
 
         showMainSection();
         loadUserUrls();
@@ -203,18 +205,102 @@ async function login() {
     }
 }
 
-function logout() {
+function saveSession(data) {
+    authToken = data.token;
+    refreshToken = data.refresh_token;
+    currentUser = data.user_id;
+
+    localStorage.setItem('authToken', authToken);
+    localStorage.setItem('refreshToken', refreshToken);
+    localStorage.setItem('currentUser', currentUser);
+}
+
+function clearSession() {
     authToken = null;
+    refreshToken = null;
     currentUser = null;
     localStorage.removeItem('authToken');
+    localStorage.removeItem('refreshToken');
     localStorage.removeItem('currentUser');
+}
+
+// refreshSession trades the refresh token for new tokens. Concurrent callers
+// share one request, since a refresh token only works once.
+let refreshing = null;
+function refreshSession() {
+    if (!refreshing) {
+        refreshing = (async () => {
+            if (!refreshToken) {
+                return false;
+            }
+
+            const response = await fetch('/api/auth/refresh', {
+                method: 'POST',
+                headers: {
+                    'Content-Type': 'application/json'
+                },
+                body: JSON.stringify({ refresh_token: refreshToken })
+            });
+
+            if (!response.ok) {
+                return false;
+            }
+
+            saveSession(await response.json());
+            return true;
+        })().catch(() => false).finally(() => {
+            refreshing = null;
+        });
+    }
+    return refreshing;
+}
+
+// authFetch sends an authenticated request. When the access token has
+// expired it refreshes the session once and retries; if that fails too the
+// user is logged out.
+async function authFetch(url, options = {}) {
+    const send = () => fetch(url, {
+        ...options,
+        headers: {
+            ...options.headers,
+            'Authorization': `Bearer ${authToken}`
+        }
+    });
+
+    let response = await send();
+    if (response.status === 401) {
+        if (await refreshSession()) {
+            response = await send();
+        } else {
+            endSession('Session expired, please log in again');
+        }
+    }
+    return response;
+}
+
+function logout() {
+    fetch('/api/auth/logout', {
+        method: 'POST',
+        headers: {
+            'Content-Type': 'application/json',
+            'Authorization': `Bearer ${authToken}`
+        },
+        body: JSON.stringify({ refresh_token: refreshToken })
+    }).catch(() => {});
+
+    endSession('Logged out successfully');
+}
+
+function endSession(message) {
+    stopStatsStream();
+    clearSession();
 
     document.getElementById('authSection').classList.remove('hidden');
     document.getElementById('mainSection').classList.add('hidden');
     showLoginForm();
     document.getElementById('username').value = '';
     document.getElementById('password').value = '';
-    showToast('Logged out successfully');
+    showToast(message);
 }
 
 function showMainSection() {
@@ -239,11 +325,10 @@ async function createShortUrl() {
     }
 
     try {
-        const response = await fetch('/api/shorten', {
+        const response = await authFetch('/api/shorten', {
             method: 'POST',
             headers: {
-                'Content-Type': 'application/json',
-                'Authorization': `Bearer ${authToken}`
+                'Content-Type': 'application/json'
             },
             body: JSON.stringify({
                 url: originalUrl,
@@ -276,12 +361,23 @@ async function createShortUrl() {
 }
 
 async function loadUserUrls() {
+    userUrls = [];
+    urlsPageToken = '';
+    await loadUrlsPage();
+}
+
+async function loadMoreUrls() {
+    if (urlsPageToken) {
+        await loadUrlsPage();
+    }
+}
+
+// loadUrlsPage appends the page after urlsPageToken to the list.
+async function loadUrlsPage() {
     try {
-        const response = await fetch('/api/urls', {
-            method: 'GET',
-            headers: {
-                'Authorization': `Bearer ${authToken}`
-            }
+        const url = urlsPageToken ? `/api/urls?page_token=${encodeURIComponent(urlsPageToken)}` : '/api/urls';
+        const response = await authFetch(url, {
+            method: 'GET'
         });
 
         if (!response.ok) {
@@ -289,13 +385,17 @@ async function loadUserUrls() {
         }
 
         const data = await response.json();
-        displayUrls(data.urls || []);
+        userUrls = userUrls.concat(data.urls || []);
+        urlsPageToken = data.next_page_token || '';
+        displayUrls(userUrls, !data.clicks_unavailable);
+        document.getElementById('loadMoreBtn').classList.toggle('hidden', !urlsPageToken);
+        renderLiveStats();
     } catch (error) {
         showToast('Error loading URLs: ' + error.message);
     }
 }
 
-function displayUrls(urls) {
+function displayUrls(urls, showClicks) {
     const urlList = document.getElementById('urlList');
 
     if (urls.length === 0) {
@@ -312,7 +412,7 @@ function displayUrls(urls) {
             <div class="url-original">${url.original_url}</div>
             <div class="url-stats">
                 ${translations[currentLang].created} ${new Date(url.created_at * 1000).toLocaleString()}
-                <span id="stats-${url.short_code}"></span>
+                <span id="stats-${url.short_code}">${showClicks ? ` | ${translations[currentLang].clicks} ${url.clicks || 0}` : ''}</span>
             </div>
         </div>
     `).join('');
@@ -326,7 +426,7 @@ function displayUrls(urls) {
 
 async function loadStats(shortCode) {
     try {
-        const response = await fetch(`/api/stats?code=${shortCode}`, {
+        const response = await authFetch(`/api/stats?code=${shortCode}`, {
             method: 'GET'
         });
 
@@ -335,11 +435,16 @@ async function loadStats(shortCode) {
         }
 
         const data = await response.json();
-        const statsElement = document.getElementById(`stats-${shortCode}`);
 
-        if (statsElement) {
-            statsElement.innerHTML = ` | ${translations[currentLang].clicks} ${data.stats.total_clicks} (${data.stats.unique_clicks} ${translations[currentLang].unique})`;
-        }
+        stopStatsStream();
+        liveStats = {
+            shortCode,
+            total: data.stats.total_clicks || 0,
+            unique: data.stats.unique_clicks || 0,
+            controller: new AbortController()
+        };
+        renderLiveStats();
+        streamStats(liveStats);
 
         showToast(`Stats loaded: ${data.stats.total_clicks} total clicks`);
     } catch (error) {
@@ -347,6 +452,84 @@ async function loadStats(shortCode) {
     }
 }
 
+function renderLiveStats() {
+    if (!liveStats) {
+        return;
+    }
+
+    const statsElement = document.getElementById(`stats-${liveStats.shortCode}`);
+    if (statsElement) {
+        const live = liveStats.streaming ? ` • ${translations[currentLang].live}` : '';
+        statsElement.innerHTML = ` | ${translations[currentLang].clicks} ${liveStats.total} (${liveStats.unique} ${translations[currentLang].unique})${live}`;
+    }
+}
+
+function stopStatsStream() {
+    if (liveStats) {
+        liveStats.controller.abort();
+        liveStats = null;
+    }
+}
+
+// streamStats reads the link's Server-Sent Events and counts each human click
+// as it arrives. fetch is used instead of EventSource, which cannot send the
+// Authorization header.
+async function streamStats(stats) {
+    try {
+        const response = await authFetch(`/api/stats/stream?code=${stats.shortCode}`, {
+            method: 'GET',
+            signal: stats.controller.signal
+        });
+
+        if (!response.ok) {
+            throw new Error(await response.text() || 'Failed to stream stats');
+        }
+
+        stats.streaming = true;
+        renderLiveStats();
+
+        const reader = response.body.pipeThrough(new TextDecoderStream()).getReader();
+        let buffer = '';
+
+        while (true) {
+            const { value, done } = await reader.read();
+            if (done) {
+                break;
+            }
+
+            buffer += value;
+            let end;
+            while ((end = buffer.indexOf('\n\n')) !== -1) {
+                const message = buffer.slice(0, end);
+                buffer = buffer.slice(end + 2);
+
+                const data = message.split('\n')
+                    .filter(line => line.startsWith('data: '))
+                    .map(line => line.slice(6))
+                    .join('\n');
+                if (!data) {
+                    continue;
+                }
+
+                const click = JSON.parse(data);
+                if (!click.is_bot && liveStats === stats) {
+                    stats.total++;
+                    renderLiveStats();
+                }
+            }
+        }
+    } catch (error) {
+        if (error.name !== 'AbortError') {
+            showToast('Live stats stopped: ' + error.message);
+        }
+    } finally {
+        stats.streaming = false;
+        if (liveStats === stats) {
+            renderLiveStats();
+        }
+    }
+}
+
 function copyToClipboard() {
     const shortUrl = document.getElementById('shortUrl');
     shortUrl.select();
@@ -437,6 +620,12 @@ document.addEventListener('DOMContentLoaded', () => {
         refreshBtn.addEventListener('click', loadUserUrls);
     }
 
+    // Load more URLs button
+    const loadMoreBtn = document.getElementById('loadMoreBtn');
+    if (loadMoreBtn) {
+        loadMoreBtn.addEventListener('click', loadMoreUrls);
+    }
+
     // Handle Enter key in login form
     const usernameInput = document.getElementById('username');
     const passwordInput = document.getElementById('password');